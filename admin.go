@@ -0,0 +1,214 @@
+package modern
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/julienschmidt/httprouter"
+	js "github.com/rshmelev/go-json-light"
+)
+
+/*
+	admin api, enabled when both TrivialSetupConf.AdminURL and AdminToken are set.
+	every request needs "Authorization: Bearer <AdminToken>" (or X-Admin-Token header)
+
+	GET   /admin/dyn           current dyn, secrets are masked
+	GET   /admin/local         current local, secrets are masked
+	GET   /admin/state         current state
+	PATCH /admin/state         Content-Type application/merge-patch+json (default) - RFC 7386
+	                           Content-Type application/json-patch+json - RFC 6902
+	POST  /admin/dyn/reload    loads dyn right away
+
+	every mutation goes to the app log and to AdminAuditLog (json line per request).
+	patched state is validated and saved before it is applied to the current one
+*/
+
+const (
+	contentTypeMergePatch = "application/merge-patch+json"
+	contentTypeJSONPatch  = "application/json-patch+json"
+
+	maxAdminBodySize = 10 << 20
+)
+
+type AuditRecord struct {
+	Time   string          `json:"time"`
+	Remote string          `json:"remote"`
+	Action string          `json:"action"`
+	Patch  json.RawMessage `json:"patch,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+type auditLog struct {
+	file     string
+	log      SimpleLogFunc
+	errorLog SimpleLogFunc
+	mutex    sync.Mutex
+}
+
+func (l *auditLog) Write(rec *AuditRecord) {
+	rec.Time = time.Now().UTC().Format(time.RFC3339)
+	b, _ := json.Marshal(rec)
+	line := RedactSecrets(string(b))
+	l.log("AUDIT " + line)
+	if l.file == "" {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	f, err := os.OpenFile(l.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		l.errorLog("cannot write audit log "+l.file+": ", err)
+		return
+	}
+	defer f.Close()
+	f.WriteString(line + "\n")
+}
+
+// applies RFC 7386 merge patch or RFC 6902 json patch to state, see UpdateState
+func (c *ModernConf) PatchState(patch []byte, jsonPatch bool) (js.IReadonlyObject, error) {
+	state, err := c.changeState(func(cur js.IObject) (js.IObject, error) {
+		doc := cur.ToByteArray(0)
+		var res []byte
+		var err error
+		if jsonPatch {
+			var p jsonpatch.Patch
+			if p, err = jsonpatch.DecodePatch(patch); err == nil {
+				res, err = p.Apply(doc)
+			}
+		} else {
+			res, err = jsonpatch.MergePatch(doc, patch)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(res, &m); err != nil || m == nil {
+			return nil, errors.New("state has to be an object")
+		}
+		return js.NewObjectFromBytes(res)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return state.ToReadonlyObject(), nil
+}
+
+//=======================================================================
+
+func (a *App) adminAuthorized(r *http.Request) bool {
+	token := r.Header.Get("X-Admin-Token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.Conf.AdminToken)) == 1
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, b []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+func writeAdminError(w http.ResponseWriter, code int, err error) {
+	b, _ := json.Marshal(map[string]string{"error": RedactSecrets(err.Error())})
+	writeAdminJSON(w, code, b)
+}
+
+// registers admin routes on app router
+func (a *App) attachAdminHandlers(audit *auditLog) {
+	c := a.Conf
+	root := strings.TrimSuffix(c.AdminURL, "/")
+	mc := a.ModernConf
+
+	auth := func(h httprouter.Handle) httprouter.Handle {
+		return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			if !a.adminAuthorized(r) {
+				a.Log.Warn("unauthorized admin request ", r.Method, " ", r.URL.Path, " from ", r.RemoteAddr)
+				writeAdminError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+				return
+			}
+			h(w, r, ps)
+		}
+	}
+	view := func(get func() js.IReadonlyObject) httprouter.Handle {
+		return auth(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			o := get()
+			if o == nil {
+				writeAdminError(w, http.StatusServiceUnavailable, errors.New("configuration is not loaded"))
+				return
+			}
+			writeAdminJSON(w, http.StatusOK, []byte(RedactSecrets(string(o.ToByteArray(2)))))
+		})
+	}
+
+	a.Router.GET(root+"/dyn", view(func() js.IReadonlyObject {
+		if mc.dyn == nil {
+			return nil
+		}
+		return mc.Dyn()
+	}))
+	a.Router.GET(root+"/local", view(mc.Local))
+	a.Router.GET(root+"/state", view(func() js.IReadonlyObject {
+		if mc.currentState() == nil {
+			return nil
+		}
+		return mc.State()
+	}))
+
+	a.Router.PATCH(root+"/state", auth(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		rec := &AuditRecord{Remote: r.RemoteAddr, Action: "patch state"}
+		defer audit.Write(rec)
+
+		patch, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAdminBodySize))
+		if err == nil && !json.Valid(patch) {
+			err = errors.New("patch is not valid json")
+		}
+		if err != nil {
+			rec.Error = err.Error()
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		rec.Patch = patch
+		jsonPatch := strings.HasPrefix(r.Header.Get("Content-Type"), contentTypeJSONPatch)
+		if jsonPatch {
+			rec.Action = "json patch state"
+		} else {
+			rec.Action = "merge patch state"
+		}
+
+		state, err := mc.PatchState(patch, jsonPatch)
+		if err != nil {
+			rec.Error = err.Error()
+			writeAdminError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, state.ToByteArray(2))
+	}))
+
+	a.Router.POST(root+"/dyn/reload", auth(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		rec := &AuditRecord{Remote: r.RemoteAddr, Action: "reload dyn"}
+		defer audit.Write(rec)
+
+		if err := mc.ReloadDyn(); err != nil {
+			rec.Error = err.Error()
+			writeAdminError(w, http.StatusBadGateway, err)
+			return
+		}
+		if e := mc.dyn.LastError(); e != "" {
+			rec.Error = e
+			writeAdminError(w, http.StatusUnprocessableEntity, errors.New(e))
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, []byte(`{"reloaded":true}`))
+	}))
+
+	a.Log.Info("admin api is available at " + root + "/")
+}
@@ -0,0 +1,152 @@
+package modern
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	js "github.com/rshmelev/go-json-light"
+)
+
+func stateTestConf(t *testing.T, state string) *ModernConf {
+	t.Helper()
+	o, err := js.NewObjectFromBytes([]byte(state))
+	if err != nil {
+		t.Fatalf("bad test json %s: %v", state, err)
+	}
+	c := &ModernConf{StateFile: filepath.Join(t.TempDir(), "state.json")}
+	c.state, _ = js.GetSynchronizedWrapper(o).(*js.SynchronizedObjectWrapper)
+	if c.state == nil {
+		t.Fatal("cannot wrap state")
+	}
+	return c
+}
+
+func stateTestValue(t *testing.T, b []byte) interface{} {
+	t.Helper()
+	v, err := decodeJSONBytes(b)
+	if err != nil {
+		t.Fatalf("bad json %s: %v", b, err)
+	}
+	return v
+}
+
+func TestPatchState(t *testing.T) {
+	cases := []struct {
+		name      string
+		patch     string
+		jsonPatch bool
+		schema    string
+		res       string
+		err       string
+	}{
+		{"merge patch", `{"a":{"y":2},"n":9007199254740993}`, false, "", `{"a":{"x":1,"y":2},"b":"keep","n":9007199254740993}`, ""},
+		{"merge patch deletes", `{"b":null}`, false, "", `{"a":{"x":1}}`, ""},
+		{"json patch deletes", `[{"op":"add","path":"/a/y","value":2},{"op":"remove","path":"/b"}]`, true, "", `{"a":{"x":1,"y":2}}`, ""},
+		{"failed json patch", `[{"op":"remove","path":"/missing"}]`, true, "", "", "missing"},
+		{"not an object", `[{"op":"replace","path":"","value":[1]}]`, true, "", "", "state has to be an object"},
+		{"schema", `{"b":1}`, false, `{"properties":{"b":{"type":"string"}}}`, "", "b"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := stateTestConf(t, `{"a":{"x":1},"b":"keep"}`)
+			if tc.schema != "" {
+				var err error
+				if c.stateSchema, err = loadSchema(tc.schema, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			live := c.State()
+			_, canRemove := js.IObject(c.state).(jsonKeyRemover)
+			if !canRemove && strings.Contains(tc.name, "deletes") {
+				t.Skip("state object of go-json-light can't remove keys")
+			}
+
+			res, err := c.PatchState([]byte(tc.patch), tc.jsonPatch)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error with %q, got %v", tc.err, err)
+				}
+				if v := stateTestValue(t, live.ToByteArray(0)); !reflect.DeepEqual(v, stateTestValue(t, []byte(`{"a":{"x":1},"b":"keep"}`))) {
+					t.Fatalf("failed patch has changed state: %s", live.ToByteArray(0))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := stateTestValue(t, []byte(tc.res))
+			for name, b := range map[string][]byte{"result": res.ToByteArray(0), "cached State()": live.ToByteArray(0)} {
+				if v := stateTestValue(t, b); !reflect.DeepEqual(v, expected) {
+					t.Fatalf("%s: expected %s, got %s", name, tc.res, b)
+				}
+			}
+			saved, err := ioutil.ReadFile(c.StateFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v := stateTestValue(t, saved); !reflect.DeepEqual(v, expected) {
+				t.Fatalf("saved: expected %s, got %s", tc.res, saved)
+			}
+		})
+	}
+}
+
+func TestUpdateStateKeepsConcurrentPuts(t *testing.T) {
+	c := stateTestConf(t, `{"a":1,"b":1}`)
+	live := c.State()
+	_, err := c.UpdateState(func(state js.IObject) error {
+		live.Put("b", 2) // somebody else changes another key meanwhile
+		state.Put("a", 3)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := stateTestValue(t, []byte(`{"a":3,"b":2}`))
+	if v := stateTestValue(t, c.State().ToByteArray(0)); !reflect.DeepEqual(v, expected) {
+		t.Fatalf("expected %v, got %s", expected, c.State().ToByteArray(0))
+	}
+	if c.State() != live {
+		t.Fatal("state object has been replaced")
+	}
+}
+
+func TestUpdateStateSaveFailure(t *testing.T) {
+	c := stateTestConf(t, `{"a":1}`)
+	c.StateFile = filepath.Join(c.StateFile, "not", "a", "dir")
+	_, err := c.UpdateState(func(state js.IObject) error {
+		state.Put("a", 2)
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected save error")
+	}
+	if v := stateTestValue(t, c.State().ToByteArray(0)); !reflect.DeepEqual(v, stateTestValue(t, []byte(`{"a":1}`))) {
+		t.Fatalf("state has changed after failed save: %s", c.State().ToByteArray(0))
+	}
+}
+
+func TestLoadAllInvalidState(t *testing.T) {
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "state.json")
+	saved := []byte(`{"b":1}`)
+	if err := ioutil.WriteFile(stateFile, saved, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "dyn.json"), []byte(`{}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := SetupConf(dir, &ModernConf{StateSchema: `{"properties":{"b":{"type":"string"}}}`})
+	defer c.Close()
+
+	err := c.LoadAll()
+	if err == nil || !strings.Contains(err.Error(), "doesn't match the schema") {
+		t.Fatalf("expected schema error, got %v", err)
+	}
+	if b, _ := ioutil.ReadFile(stateFile); string(b) != string(saved) {
+		t.Fatalf("state file has been changed: %s", b)
+	}
+}
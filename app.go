@@ -0,0 +1,530 @@
+package modern
+
+import (
+	"context"
+	"errors"
+	"flag"
+	stdlog "log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/kelseyhightower/envconfig"
+	. "github.com/rshmelev/go-initstruct"
+	interrupts "github.com/rshmelev/go-inthandler"
+	js "github.com/rshmelev/go-json-light"
+	. "github.com/rshmelev/go-ternary/if"
+	"github.com/rshmelev/gologs/libgologs"
+	"github.com/rshmelev/restarter/librestarter"
+)
+
+/*
+	App owns everything TrivialSetup used to keep in globals,
+	so few apps can live in one process (tests!)
+
+	app, err := modern.NewApp(
+		modern.WithConf(&modern.TrivialSetupConf{AppName: "myapp", HttpBind: ":8080"}),
+		modern.WithEnvConf(&myenv),
+	)
+	... configure routes using app.Router ...
+	err = app.Start()
+	app.Wait()
+
+	by default app is integrated with the process: interrupts, os.Args, service installer,
+	restarter and package globals (AppDir, FullAppString, Debug, ...).
+	use WithoutProcessIntegration() for embedding and tests
+*/
+
+type App struct {
+	Conf    *TrivialSetupConf
+	EnvConf interface{}
+
+	AppDir        string
+	FullName      string // company-appname
+	FullAppString string // company + appname + version + buildtime
+	Debug         bool
+	BuildInfo     *BuildInfo
+	Templates     *TemplateData // for string values of configuration
+	F             *UsefulFunctions
+
+	Log         libgologs.SomeLogger
+	LogConf     *libgologs.CoolLogger
+	ModernConf  *ModernConf
+	Router      *httprouter.Router // nil in headless mode unless AdminURL is set
+	Server      *http.Server
+	HealthPoint js.IObject
+	Lifecycle   *Lifecycle
+	Components  *ComponentRegistry
+	Commands    *CommandRegistry // app specific, see also DefaultCommands
+
+	DrainTimeout time.Duration
+
+	processIntegration bool
+	args               []string
+	setupConfTracker   *confTracker
+	envConfTracker     *confTracker
+	envOrigins         map[string]string // env var -> file it was loaded from
+	envReport          []*EnvFileReport
+	envConfFlags       *confFlags
+	logsPath           string
+	extraComponents    []Component
+}
+
+type AppOption func(a *App)
+
+func WithConf(c *TrivialSetupConf) AppOption {
+	return func(a *App) {
+		a.Conf = c
+	}
+}
+
+// struct to be filled by envconfig using AppName prefix
+func WithEnvConf(envconf interface{}) AppOption {
+	return func(a *App) {
+		a.EnvConf = envconf
+	}
+}
+
+// by default it is the folder of executable
+func WithAppDir(dir string) AppOption {
+	return func(a *App) {
+		a.AppDir = dir
+	}
+}
+
+// command line arguments without program name, os.Args[1:] by default
+func WithArgs(args []string) AppOption {
+	return func(a *App) {
+		a.args = args
+	}
+}
+
+// third-party component, it is initialized together with built-in ones
+func WithComponent(c Component) AppOption {
+	return func(a *App) {
+		a.extraComponents = append(a.extraComponents, c)
+	}
+}
+
+// app specific special command
+func WithCommand(cmd *Command) AppOption {
+	return func(a *App) {
+		a.Commands.Register(cmd)
+	}
+}
+
+// no interrupts handling, no special commands, no std log takeover, no globals
+func WithoutProcessIntegration() AppOption {
+	return func(a *App) {
+		a.processIntegration = false
+	}
+}
+
+// the App that was created by TrivialSetup
+var DefaultApp *App
+
+// does everything TrivialSetup did, returns *SetupError if something went wrong
+func NewApp(opts ...AppOption) (*App, error) {
+	a := &App{
+		Conf:               &TrivialSetupConf{},
+		Commands:           NewCommandRegistry(),
+		AppDir:             ".",
+		F:                  &UsefulFunctions{},
+		DrainTimeout:       HttpDrainTimeout,
+		processIntegration: true,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	if a.processIntegration {
+		a.Lifecycle = AppLifecycle
+		if a.args == nil {
+			a.args = os.Args[1:]
+		}
+	} else {
+		a.Lifecycle = NewLifecycle()
+	}
+
+	if err := a.setupEnv(); err != nil {
+		return a, err
+	}
+	if err := a.setupLogs(); err != nil {
+		return a, err
+	}
+	if err := a.setupConf(); err != nil {
+		return a, err
+	}
+	a.setupHttp()
+
+	a.Components = NewComponentRegistry()
+	a.registerBuiltinComponents()
+	for _, c := range a.extraComponents {
+		if err := a.Components.Register(c); err != nil {
+			return a, &SetupError{StageComponents, "cannot register component", err}
+		}
+	}
+	if err := a.Components.InitAll(a); err != nil {
+		return a, &SetupError{StageComponents, "cannot init components", err}
+	}
+
+	a.probablyRunCommand(true)
+
+	return a, nil
+}
+
+// adds component to the app, it is initialized right away if app is already set up
+func (a *App) Register(c Component) error {
+	if err := a.Components.Register(c); err != nil {
+		return err
+	}
+	return a.Components.InitAll(a)
+}
+
+func (a *App) setupEnv() error {
+	c := a.Conf
+
+	if a.processIntegration {
+		if matched, err := regexp.Match("go-build\\d+.+", []byte(os.Args[0])); !matched && err == nil {
+			if appdir, err := filepath.Abs(filepath.Dir(os.Args[0])); err == nil {
+				a.AppDir = appdir
+			}
+		}
+		AppDir = a.AppDir
+	}
+
+	a.Templates = NewTemplateData(a.AppDir, c.AppName, c.CompanyName)
+	a.setupConfTracker = newConfTracker(c.AppName, c)
+	InitZeroFieldsRecursively(c)
+	a.setupConfTracker.Stage("init tag")
+	a.BuildInfo = c.FillFromBuildInfo(ReadBuildInfo())
+	a.setupConfTracker.Stage("build info")
+
+	a.Debug = false
+	rand.Seed(time.Now().UTC().UnixNano())
+
+	a.FullName = c.CompanyName + "-" + c.AppName
+	if c.CompanyName == "" {
+		a.FullName = c.AppName
+	}
+	a.FullAppString = a.buildFullAppString()
+
+	// every App has its own flags, process integrated one parses flag.CommandLine
+	// as before, so flags of the app itself, flag.Parsed() and flag.Args() keep working
+	flags := flag.NewFlagSet(c.AppName, flag.ContinueOnError)
+	if a.processIntegration {
+		flags = flag.CommandLine
+	}
+	if flags.Lookup("v") == nil {
+		flags.Bool("v", false, "get version")
+	}
+	if flags.Lookup("logto") == nil {
+		flags.String("logto", "", "full path of rotating log (default <logspath>/"+a.FullName+".log)")
+	}
+	setupFlags := defineConfFlags(flags, c.AppName, c)
+	a.envConfFlags = defineConfFlags(flags, c.AppName, a.EnvConf)
+
+	envFiles, envStrict, err := a.envFilesSettings()
+	if err != nil {
+		return err
+	}
+	if err := a.loadEnvFiles(envFiles, envStrict); err != nil {
+		return err
+	}
+
+	//TrivialSetupConf
+	if enverr := envconfig.Process(c.AppName, c); enverr != nil {
+		return &SetupError{StageEnv, "envconfig.Process of TrivialSetupConf failed", enverr}
+	}
+	a.setupConfTracker.Stage("env")
+
+	// flags override env
+	if err := flags.Parse(a.args); err != nil {
+		return &SetupError{StageEnv, "cannot parse command line", err}
+	}
+	if err := setupFlags.Apply(); err != nil {
+		return &SetupError{StageEnv, "cannot apply command line flags", err}
+	}
+	a.setupConfTracker.Stage("flag")
+
+	// {{ .AppDir }}, {{ .Hostname }}, ... see TemplateData
+	a.Templates.AppName = c.AppName
+	a.Templates.CompanyName = c.CompanyName
+	if err := a.Templates.ExpandStruct(c.AppName, c); err != nil {
+		return &SetupError{StageEnv, "template expansion failed", err}
+	}
+	a.setupConfTracker.Stage("template")
+
+	// file://, env://, exec:// values, see secrets.go
+	if err := resolveStructSecrets(c.AppName, c); err != nil {
+		return &SetupError{StageEnv, "secret reference resolution failed", err}
+	}
+	a.setupConfTracker.Stage("secret ref")
+
+	a.logsPath, err = a.Templates.Expand(flags.Lookup("logto").Value.String())
+	if err != nil {
+		return &SetupError{StageEnv, "template expansion of -logto failed", err}
+	}
+	if a.logsPath == "" {
+		a.logsPath = c.LogsPath + "/" + a.FullName + ".log"
+	}
+
+	if a.processIntegration {
+		FullAppString = a.FullAppString
+		interrupts.StopPointer = &Stop
+		StopChannel = interrupts.StopChannel
+		a.Lifecycle.WatchInterrupts(interrupts.StopChannel)
+		// __phoenix makes this process the restarter, children do the handshake with it
+		librestarter.ProbablyBecomeRestarter(a.restarterOptions())
+	}
+	a.probablyRunCommand(false)
+
+	if c.HttpDrainTimeout != 0 {
+		a.DrainTimeout = c.HttpDrainTimeout
+	}
+
+	a.Debug = os.Getenv(strings.ToUpper(c.AppName)+"_DEVMODE") == "1"
+	if a.processIntegration {
+		Debug = a.Debug
+	}
+
+	return nil
+}
+
+func (a *App) buildFullAppString() string {
+	c := a.Conf
+	s := a.FullName + " v" + c.Version +
+		If(!c.IsForProduction).Then(" (DEBUG)").Else("").Str()
+	s += If(c.BuildTime != "").Then(" built on " + c.BuildTime).Else("").Str()
+	s += If(c.GoVersion != "").Then(" (" + c.GoVersion + ")").Else("").Str()
+
+	if c.CodeRev != "" && len(c.CodeRev) > 6 {
+		mod := ""
+		if c.ModifiedSources != "" {
+			mods := strings.Split(c.ModifiedSources, "\n")
+			firstmods := mods
+			if len(mods) > 3 {
+				firstmods = mods[:3]
+				mods = mods[3:]
+			} else {
+				mods = []string{}
+			}
+			mod = strings.Join(firstmods, ", ") +
+				If(len(mods) > 0).Then(
+					" and "+strconv.Itoa(len(mods))+" more").Else("").Str()
+			if len(mod) > 0 {
+				mod = " + modified " + mod
+			}
+		}
+
+		s += " (rev=" + c.CodeRev[:6] + mod + ")"
+	}
+	return s
+}
+
+func (a *App) setupLogs() error {
+	c := a.Conf
+
+	UseAllCores()
+	TrackMemStats()
+
+	if c.LogsPath != "-" {
+		if err := os.MkdirAll(c.LogsPath, 0755); err != nil {
+			return &SetupError{StageLogs, "cannot create logs folder: " + c.LogsPath, err}
+		}
+	} else {
+		a.logsPath = ""
+	}
+	a.LogConf = &libgologs.CoolLogger{
+		FullLogFilename: a.logsPath,
+		MemoryLimit:     5000,
+	}
+	coollog := libgologs.NewCoolLogger(a.LogConf) //defer log.Flush()
+	log := &redactingLogger{coollog}
+	a.Log = log
+	if a.processIntegration {
+		coollog.SetAsStdLogWriter(StdLogFlags)
+		stdlog.SetOutput(&redactingWriter{stdlog.Writer()})
+		stdlog.Println("std log package integration check...")
+	}
+
+	log.Info("starting " + a.FullAppString)
+	if c.CompanySite != "" {
+		log.Info("get more info about " + c.AppName + " at http://" + c.CompanySite)
+	}
+	if !c.IsForProduction {
+		LogNotForProductionMessage()
+	}
+	a.logEnvReport()
+
+	a.Lifecycle.Log = log.Info
+	a.Lifecycle.ErrorLog = log.Error
+
+	return nil
+}
+
+func (a *App) setupConf() error {
+	c := a.Conf
+
+	a.ModernConf = SetupConf(c.ConfPath, &ModernConf{
+		DevMode:            a.Debug,
+		AppName:            c.AppName,
+		Log:                a.Log.Info,
+		ErrorLog:           a.Log.Error,
+		StateFile:          c.StateFile,
+		LocalConfFile:      c.LocalConfFile,
+		DynConfUrl:         c.DynConfUrl,
+		DynCacheFile:       c.DynCacheFile,
+		DynSigningKeys:     c.DynSigningKeys,
+		Lifecycle:          a.Lifecycle,
+		Templates:          a.Templates,
+		ExpandDynTemplates: c.ExpandDynTemplates,
+		DynSchema:          c.DynSchema,
+		LocalSchema:        c.LocalSchema,
+		StateSchema:        c.StateSchema,
+		DynStartupTimeout:  c.DynStartupTimeout,
+		DynMaxBackoff:      c.DynMaxBackoff,
+		DynJitter:          c.DynJitter,
+		LocalHotReload:     c.LocalConfHotReload,
+	})
+
+	if a.EnvConf != nil {
+		a.envConfTracker = newConfTracker(c.AppName, a.EnvConf)
+		if e := envconfig.Process(c.AppName, a.EnvConf); e != nil {
+			return &SetupError{StageEnv, "envconfig.Process failed", e}
+		}
+		a.envConfTracker.Stage("env")
+		if e := a.envConfFlags.Apply(); e != nil {
+			return &SetupError{StageEnv, "cannot apply command line flags", e}
+		}
+		a.envConfTracker.Stage("flag")
+		if e := resolveStructSecrets(c.AppName, a.EnvConf); e != nil {
+			return &SetupError{StageEnv, "secret reference resolution failed", e}
+		}
+		a.envConfTracker.Stage("secret ref")
+	}
+
+	if err := a.checkUnknownEnvVars(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (a *App) setupHttp() {
+	c := a.Conf
+	log := a.Log
+
+	a.HealthPoint = NewHealthPoint(a.Context(), a.FullName, c.Version, a.Debug)
+	a.HealthPoint.Put("buildtime", c.BuildTime)
+	a.HealthPoint.Put("build", a.BuildInfo.ToMap())
+
+	if c.Headless {
+		log.Info("headless mode, http server is disabled")
+		if good(c.AdminURL) {
+			// for admin api, the app can serve it on its own listener
+			a.Router = httprouter.New()
+		}
+		return
+	}
+
+	s := &http.Server{
+		Addr: c.HttpBind,
+	}
+
+	a.Server, a.Router, _, _ = SetupHttpServer(a.Debug, s, log,
+		GetAccessLogHandler(log,
+			[]string{c.StaticContentRootURL},
+			map[string]bool{c.HealthPointURL: true, c.VersionURL: true, c.ConfigDumpURL: true, c.MonitorsUrl: true, c.WebsocketLogsRoot: true}))
+}
+
+// starts components (configuration is loaded by "conf" component) and http server (if not headless)
+func (a *App) Start() error {
+	if a.Components == nil {
+		// App was not created by NewApp
+		a.Components = NewComponentRegistry()
+		a.registerBuiltinComponents()
+	}
+	if err := a.Components.InitAll(a); err != nil {
+		return &SetupError{StageComponents, "cannot init components", err}
+	}
+	if err := a.Components.StartAll(a.Context(), a.Lifecycle); err != nil {
+		var serr *SetupError
+		if errors.As(err, &serr) {
+			return serr
+		}
+		return &SetupError{StageComponents, "cannot start components", err}
+	}
+
+	if a.Server != nil {
+		if err := a.startHttpServer(); err != nil {
+			return err
+		}
+	}
+
+	if a.processIntegration {
+		// before this moment, better to have some ctrl+c
+		interrupts.TakeCareOfInterrupts(false)
+	}
+
+	return nil
+}
+
+func (a *App) startHttpServer() error {
+	server := a.Server
+	addr := server.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return &SetupError{StageListen, "cannot listen on " + addr, err}
+	}
+
+	drainer := AttachHttpDrainer(server)
+	drainer.Log = a.Log.Info
+	drainer.ErrorLog = a.Log.Error
+	a.Lifecycle.OnShutdown("http server", func(ctx context.Context) error {
+		return drainer.Drain(ctx, server, a.DrainTimeout)
+	})
+
+	go func() {
+		a.Log.Info("HTTP server is listening ", server.Addr)
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			a.Log.Error("HTTP Server failed with error: ", err)
+			a.interrupt()
+		}
+	}()
+	return nil
+}
+
+// graceful stop: cancels app context and runs shutdown hooks
+func (a *App) Stop() {
+	a.Lifecycle.Shutdown()
+}
+
+// blocks until app is stopped
+func (a *App) Wait() {
+	<-a.Lifecycle.Done()
+}
+
+// root context of the app, cancelled on Stop
+func (a *App) Context() context.Context {
+	return a.Lifecycle.Context()
+}
+
+func (a *App) interrupt() {
+	if a.processIntegration {
+		interrupts.InterruptTheApp()
+		return
+	}
+	go a.Stop()
+}
@@ -2,9 +2,12 @@ package modern
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"sync"
 	"time"
 
@@ -14,21 +17,78 @@ import (
 type AutoLoadFileUpdatedHandler func(oldbytes, newbytes []byte)
 type AutoLoadJSONUpdatedHandler func(oldj, newj js.IReadonlyObject)
 
+/*
+	AutoLoadFile runs one goroutine that loads Url every UpdatePeriod
+	until Stop/Close, ReloadNow wakes it up earlier.
+	UpdateHandler is called from that goroutine (or from LoadNow caller)
+	without any locks held, one call at a time
+*/
+
 type AutoLoadFile struct {
 	Url           string
 	UpdatePeriod  time.Duration
-	UpdateHandler AutoLoadFileUpdatedHandler // protected with mutex
+	UpdateHandler AutoLoadFileUpdatedHandler
+
+	// if the first load doesn't succeed (or loaded data is rejected, see AutoLoadJSON)
+	// within StartupTimeout, StartupFallback is called,
+	// and if it returns true StartLoading stops waiting and keeps retrying in background,
+	// otherwise (or without fallback) StartLoading fails
+	StartupTimeout  time.Duration
+	StartupFallback func() bool
+
+	FetchTimeout time.Duration // http timeout, 10s by default
+	MaxBackoff   time.Duration // limit of delay growth after failures, 2m by default
+	Jitter       float64       // random part of delays, 0.1 (default) means +-10%, negative disables it
+
+	// local files are watched (see filewatch.go) and polled just in case with this period, 1m by default
+	WatchPollPeriod time.Duration
+
+	// why the loaded data can't be used, StartLoading treats it as a failed load
+	rejection func() error
 
 	mutex           sync.Mutex
 	lastBody        []byte
+	contentType     string
+	etag            string
+	lastModified    string
 	failedLoading   bool
+	failures        int
+	watcher         *fileWatcher
 	handleFirstTime bool
+	stopped         bool
+
+	loadMutex    sync.Mutex // one load at a time
+	initOnce     sync.Once
+	defaultsOnce sync.Once
+	reload       chan struct{}
+	done         chan struct{}
+	loopDone     chan struct{}
+	looping      bool
 }
 
+// applied to every loaded json before it becomes active, error rejects the update
+type AutoLoadJSONTransform func(j js.IObject) (js.IObject, error)
+
 type AutoLoadJSON struct {
 	autoLoadFile  *AutoLoadFile
 	UpdateHandler AutoLoadJSONUpdatedHandler
-	json          js.IObject
+	Transform     AutoLoadJSONTransform
+	Format        string // json, yaml or toml, detected from url and Content-Type if empty
+	// checks raw body before parsing and returns the data to use
+	// and self-contained signed form of it for CacheFile, see dynsign.go
+	Verify func(body []byte) (payload []byte, signed []byte, err error)
+
+	// every accepted body is saved here as loaded (signed if Verify is set, before Transform),
+	// it is used if url is not available (or its data is rejected) at start for StartupTimeout
+	CacheFile      string
+	StartupTimeout time.Duration
+
+	mutex      sync.Mutex
+	json       js.IObject
+	handleNext bool
+	stale      bool
+	lastError  string
+	version    int // incremented on every accepted update
 }
 
 func (c *AutoLoadFile) Data() []byte {
@@ -37,63 +97,273 @@ func (c *AutoLoadFile) Data() []byte {
 	return c.lastBody
 }
 
-func (c *AutoLoadFile) LoadNow() error {
-	r := F.GetByteContents(c.Url, c.UpdatePeriod)
+// the same content will be handled again on the next load
+func (c *AutoLoadFile) forget() {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	c.lastBody = []byte{}
+	c.etag, c.lastModified = "", ""
+}
+
+func (c *AutoLoadFile) ContentType() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.contentType
+}
+
+// loads Url right away, UpdateHandler is called if content has changed
+func (c *AutoLoadFile) LoadNow() error {
+	return c.load(true)
+}
+
+// handle is false for the first load of StartLoading without handleFirstTime
+func (c *AutoLoadFile) load(handle bool) error {
+	c.loadMutex.Lock()
+	defer c.loadMutex.Unlock()
+
+	c.mutex.Lock()
+	etag, lastModified := c.etag, c.lastModified
+	c.mutex.Unlock()
 
-	if r.Err == nil && (r.Code == 200) {
+	r := F.GetByteContentsIfModified(c.Url, c.FetchTimeout, etag, lastModified)
+	c.mutex.Lock()
+
+	if r.Err == nil && (r.Code == 200 || r.Code == 304) {
 		if c.failedLoading {
 			log.Println("connection restored: " + c.Url)
 		}
 		c.failedLoading = false
-		if bytes.Compare(r.Body, c.lastBody) != 0 {
-			prevBody := c.lastBody
+		c.failures = 0
+		if r.Code == 304 {
+			c.mutex.Unlock()
+			return nil
+		}
+		c.etag, c.lastModified = r.ETag, r.LastModified
+		changed := bytes.Compare(r.Body, c.lastBody) != 0
+		prevBody := c.lastBody
+		if changed {
 			c.lastBody = r.Body
-			if c.UpdateHandler != nil {
-				c.UpdateHandler(prevBody, c.lastBody)
-			}
+			c.contentType = r.ContentType
+		}
+		handler := c.UpdateHandler
+		c.mutex.Unlock()
+
+		if changed && handle && handler != nil {
+			handler(prevBody, r.Body)
 		}
 		return nil
 	}
+	c.failedLoading = true
+	c.failures++
+	c.mutex.Unlock()
 	if r.Err != nil {
 		return r.Err
 	}
 	return errors.New(fmt.Sprint("got error code ", r.Code, " while loading dyn conf"))
 }
 
-func (c *AutoLoadFile) LoadStep() {
+// UpdatePeriod, or exponential backoff after failures, both with jitter
+func (c *AutoLoadFile) nextDelay(base time.Duration) time.Duration {
+	c.mutex.Lock()
+	failures := c.failures
+	c.mutex.Unlock()
+
+	d := base
+	for i := 0; i < failures && d < c.MaxBackoff; i++ {
+		d *= 2
+	}
+	if failures > 0 && d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	if c.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * c.Jitter * float64(d))
+	}
+	return d
+}
+
+// true if last attempt to load failed
+func (c *AutoLoadFile) Failing() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.failedLoading
+}
+
+func (c *AutoLoadFile) initChannels() {
+	c.initOnce.Do(func() {
+		c.reload = make(chan struct{}, 1)
+		c.done = make(chan struct{})
+		c.loopDone = make(chan struct{})
+	})
+}
+
+// stops autoload loop, last loaded data is still available
+func (c *AutoLoadFile) Stop() {
+	c.initChannels()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.stopped {
+		c.stopped = true
+		close(c.done)
+	}
+	if c.watcher != nil {
+		c.watcher.Close()
+		c.watcher = nil
+	}
+}
+
+// stops autoload loop and waits till it exits,
+// must not be called from UpdateHandler
+func (c *AutoLoadFile) Close() error {
+	c.Stop()
+	c.mutex.Lock()
+	looping := c.looping
+	c.mutex.Unlock()
+	if looping {
+		<-c.loopDone
+	}
+	return nil
+}
+
+// wakes up autoload loop, doesn't wait for the load, see LoadNow
+func (c *AutoLoadFile) ReloadNow() {
+	c.initChannels()
+	select {
+	case c.reload <- struct{}{}:
+	default: // already requested
+	}
+}
+
+// false if stopped while sleeping
+func (c *AutoLoadFile) sleep(d time.Duration) bool {
+	c.initChannels()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-c.done:
+		return false
+	case <-t.C:
+	case <-c.reload:
+	}
+	return true
+}
+
+func (c *AutoLoadFile) isWatched() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.watcher != nil
+}
+
+func (c *AutoLoadFile) startWatching() {
+	w, err := watchFile(c.Url, c.ReloadNow)
+	if err != nil {
+		log.Println("WARNING: cannot watch "+c.Url+", will poll it: ", err)
+		return
+	}
+	c.mutex.Lock()
+	c.watcher = w
+	c.mutex.Unlock()
+	log.Println("watching: " + c.Url)
+}
+
+func (c *AutoLoadFile) isStopped() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stopped
+}
+
+func (c *AutoLoadFile) loadLogged() {
 	err := c.LoadNow()
 	if err != nil {
 		log.Println("ERROR: failed to load: ", c.Url)
 	}
-	time.Sleep(c.UpdatePeriod)
-	go c.LoadStep()
 }
 
-func (c *AutoLoadFile) StartLoading() error {
+// loads Url and keeps loading it every UpdatePeriod until Stop, blocks.
+// StartLoading does the same in background, if its loop is running LoadStep only loads once
+func (c *AutoLoadFile) LoadStep() {
+	c.initDefaults()
+	c.loadLogged()
+	if c.claimLoop() {
+		c.loop()
+	}
+}
 
-	F.EnsureNotEmptyDuration(&c.UpdatePeriod, time.Second*5)
+// true if the caller has to run the loop: it is not running yet and not stopped
+func (c *AutoLoadFile) claimLoop() bool {
+	c.initChannels()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.stopped || c.looping {
+		return false
+	}
+	c.looping = true
+	return true
+}
+
+func (c *AutoLoadFile) loop() {
+	defer close(c.loopDone)
+	for {
+		period := c.UpdatePeriod
+		if c.isWatched() {
+			period = c.WatchPollPeriod
+		}
+		if !c.sleep(c.nextDelay(period)) {
+			return
+		}
+		c.loadLogged()
+	}
+}
+
+func (c *AutoLoadFile) initDefaults() {
+	c.defaultsOnce.Do(func() {
+		F.EnsureNotEmptyDuration(&c.UpdatePeriod, time.Second*5)
+		F.EnsureNotEmptyDuration(&c.FetchTimeout, time.Second*10)
+		F.EnsureNotEmptyDuration(&c.MaxBackoff, time.Minute*2)
+		F.EnsureNotEmptyDuration(&c.WatchPollPeriod, time.Minute)
+		if c.Jitter == 0 {
+			c.Jitter = 0.1
+		}
+	})
+}
+
+func (c *AutoLoadFile) StartLoading() error {
+	c.initDefaults()
 
 	if c.Url != "" && c.Url != "-" {
 		var err error
 
 		log.Println("trying to load: " + c.Url)
-		temp := c.UpdateHandler
-		if !c.handleFirstTime {
-			c.UpdateHandler = nil
-		}
+		started := time.Now()
 		for {
-			if err = c.LoadNow(); err == nil {
+			if err = c.load(c.handleFirstTime); err == nil && c.rejection != nil {
+				err = c.rejection()
+			}
+			if err == nil || c.isStopped() {
 				break
 			}
 			log.Println("WARNING: failed to load: ", err)
-			time.Sleep(time.Second * 2)
+			if c.StartupTimeout > 0 && time.Since(started) >= c.StartupTimeout {
+				if c.StartupFallback != nil && c.StartupFallback() {
+					break
+				}
+				return errors.New("cannot load " + c.Url + " within " + c.StartupTimeout.String() + ": " + err.Error())
+			}
+			d := c.nextDelay(time.Second * 2)
+			if left := c.StartupTimeout - time.Since(started); c.StartupTimeout > 0 && left < d {
+				d = left
+			}
+			if !c.sleep(d) {
+				break
+			}
 		}
-		c.UpdateHandler = temp
 
-		log.Println("starting autoload loop: " + c.Url)
-		go c.LoadStep()
+		if isLocalPath(c.Url) && !c.isStopped() {
+			c.startWatching()
+		}
+		if c.claimLoop() {
+			log.Println("starting autoload loop: " + c.Url)
+			go c.loop()
+		}
 		return nil
 	}
 	return nil
@@ -102,40 +372,215 @@ func (c *AutoLoadFile) StartLoading() error {
 //=======================================================================
 
 func (c *AutoLoadJSON) Data() js.IReadonlyObject {
-	c.autoLoadFile.mutex.Lock()
-	defer c.autoLoadFile.mutex.Unlock()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.json.ToReadonlyObject()
 }
 
-func StartAutoLoadingFile(url string, timeout time.Duration, handler AutoLoadFileUpdatedHandler, handleFirstTime bool) *AutoLoadFile {
-	a := &AutoLoadFile{
+func (c *AutoLoadJSON) Failing() bool {
+	return c.autoLoadFile.Failing()
+}
+
+func (c *AutoLoadJSON) Stop() {
+	c.autoLoadFile.Stop()
+}
+
+func (c *AutoLoadJSON) Close() error {
+	return c.autoLoadFile.Close()
+}
+
+func (c *AutoLoadJSON) ReloadNow() {
+	c.autoLoadFile.ReloadNow()
+}
+
+// loads url right away, error is returned if it can't be loaded
+// (rejected update is not an error, it is logged)
+func (c *AutoLoadJSON) LoadNow() error {
+	return c.autoLoadFile.LoadNow()
+}
+
+func NewAutoLoadFile(url string, period time.Duration, handler AutoLoadFileUpdatedHandler, handleFirstTime bool) *AutoLoadFile {
+	return &AutoLoadFile{
 		Url:             url,
-		UpdatePeriod:    timeout,
+		UpdatePeriod:    period,
 		UpdateHandler:   handler,
 		lastBody:        []byte{},
 		handleFirstTime: handleFirstTime,
 	}
+}
+
+func StartAutoLoadingFile(url string, timeout time.Duration, handler AutoLoadFileUpdatedHandler, handleFirstTime bool) *AutoLoadFile {
+	a := NewAutoLoadFile(url, timeout, handler, handleFirstTime)
 	a.StartLoading()
 	return a
 }
 
-func StartAutoLoadingJSON(url string, timeout time.Duration, handler AutoLoadJSONUpdatedHandler, handleFirstTime bool) *AutoLoadJSON {
-	j := &AutoLoadJSON{json: js.NewObjectOrNil(), UpdateHandler: handler}
-	handle := handleFirstTime
-	j.autoLoadFile = StartAutoLoadingFile(url, timeout, func(oldbytes, newbytes []byte) {
-		predyn, err2 := js.NewObjectFromBytes(newbytes)
-		if err2 != nil {
-			log.Println("WARNING: failed to parse loaded json: " + url)
+// not started yet, so Transform can be set before the first load
+func NewAutoLoadJSON(url string, period time.Duration, handler AutoLoadJSONUpdatedHandler, handleFirstTime bool) *AutoLoadJSON {
+	j := &AutoLoadJSON{json: js.NewObjectOrNil(), UpdateHandler: handler, handleNext: handleFirstTime}
+	j.autoLoadFile = NewAutoLoadFile(url, period, j.fileUpdated, true)
+	return j
+}
+
+// content of CacheFile
+type autoLoadCache struct {
+	Format string `json:"format"`
+	Body   string `json:"body"` // as loaded, signed if Verify is set
+}
+
+func (j *AutoLoadJSON) fileUpdated(oldbytes, newbytes []byte) {
+	cache := newbytes
+	if j.Verify != nil {
+		payload, signed, err := j.Verify(newbytes)
+		if err != nil {
+			j.rejected("WARNING: loaded data is not verified: "+j.autoLoadFile.Url+", error: ", err)
+			// signature may be published a bit later than the body, so the same body will be checked again
+			j.autoLoadFile.forget()
 			return
 		}
-		log.Println("modification detected: " + url)
-		olddyn := j.json
-		j.json = predyn
-		if j.UpdateHandler != nil && handle {
-			j.UpdateHandler(olddyn, j.json.ToReadonlyObject())
+		newbytes, cache = payload, signed
+	}
+	format := j.Format
+	if format == "" {
+		format = DetectConfFormat(j.autoLoadFile.Url, j.autoLoadFile.ContentType())
+	}
+	if j.accept(format, newbytes, false) {
+		j.saveCache(format, cache)
+	}
+}
+
+// parses, transforms and activates loaded data, false if it is rejected
+func (j *AutoLoadJSON) accept(format string, data []byte, stale bool) bool {
+	url := j.autoLoadFile.Url
+	b, err2 := ConfToJSON(format, data)
+	if err2 != nil {
+		j.rejected("WARNING: failed to parse loaded "+format+": "+url+", error: ", err2)
+		return false
+	}
+	predyn, err2 := js.NewObjectFromBytes(b)
+	if err2 != nil {
+		j.rejected("WARNING: failed to parse loaded json: "+url+", error: ", err2)
+		return false
+	}
+	if j.Transform != nil {
+		if predyn, err2 = j.Transform(predyn); err2 != nil {
+			j.rejected("WARNING: loaded json is rejected: "+url+", error: ", err2)
+			return false
+		}
+	}
+	log.Println("modification detected: " + url)
+	j.mutex.Lock()
+	olddyn := j.json
+	j.json = predyn
+	j.stale = stale
+	j.lastError = ""
+	j.version++
+	handle := j.handleNext
+	j.handleNext = true
+	j.mutex.Unlock()
+	if j.UpdateHandler != nil && handle {
+		j.UpdateHandler(olddyn, predyn.ToReadonlyObject())
+	}
+	return true
+}
+
+func (j *AutoLoadJSON) rejected(msg string, err error) {
+	log.Println(msg, err)
+	j.mutex.Lock()
+	j.lastError = err.Error()
+	j.mutex.Unlock()
+}
+
+// why the last loaded data was rejected, empty if it was accepted
+func (j *AutoLoadJSON) LastError() string {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.lastError
+}
+
+func (j *AutoLoadJSON) saveCache(format string, body []byte) {
+	if j.CacheFile == "" || j.CacheFile == "-" {
+		return
+	}
+	b, _ := json.Marshal(&autoLoadCache{Format: format, Body: string(body)})
+	if err := F.SafeWriteFile(j.CacheFile, b); err != nil {
+		log.Println("WARNING: failed to save cache: "+j.CacheFile+", error: ", err)
+	}
+}
+
+// verified content of CacheFile and its format
+func (j *AutoLoadJSON) readCache() (string, []byte, error) {
+	b, err := ioutil.ReadFile(j.CacheFile)
+	if err != nil {
+		return "", nil, err
+	}
+	var cache autoLoadCache
+	if err := json.Unmarshal(b, &cache); err != nil {
+		return "", nil, err
+	}
+	body := []byte(cache.Body)
+	if j.Verify != nil {
+		if body, _, err = j.Verify(body); err != nil {
+			return "", nil, err
 		}
-		handle = true
-	}, true)
+	}
+	return cache.Format, body, nil
+}
+
+// startup fallback: last known good data from CacheFile
+func (j *AutoLoadJSON) loadCache() bool {
+	if j.CacheFile == "" || j.CacheFile == "-" {
+		return false
+	}
+	format, b, err := j.readCache()
+	if err != nil {
+		log.Println("WARNING: "+j.autoLoadFile.Url+" is not available or rejected and there is no valid cache: ", err)
+		return false
+	}
+	j.autoLoadFile.loadMutex.Lock()
+	defer j.autoLoadFile.loadMutex.Unlock()
+	if !j.accept(format, b, true) {
+		return false
+	}
+	log.Println("WARNING: " + j.autoLoadFile.Url + " is not available or rejected, using cached " + j.CacheFile + " until it is")
+	return true
+}
+
+// nil if nothing has been accepted yet
+func (j *AutoLoadJSON) snapshot() (js.IReadonlyObject, int) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.json == nil {
+		return nil, j.version
+	}
+	return j.json.ToReadonlyObject(), j.version
+}
+
+// true if data came from CacheFile and url hasn't been loaded yet
+func (j *AutoLoadJSON) Stale() bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.stale
+}
+
+func (j *AutoLoadJSON) Start() error {
+	if j.Verify != nil && j.CacheFile != "" && j.CacheFile != "-" {
+		// Verify remembers version of the cached update, so older ones are rejected after restart
+		j.readCache()
+	}
+	j.autoLoadFile.StartupTimeout = j.StartupTimeout
+	j.autoLoadFile.StartupFallback = j.loadCache
+	j.autoLoadFile.rejection = func() error {
+		if e := j.LastError(); e != "" {
+			return errors.New("loaded data is rejected: " + e)
+		}
+		return nil
+	}
+	return j.autoLoadFile.StartLoading()
+}
 
+func StartAutoLoadingJSON(url string, timeout time.Duration, handler AutoLoadJSONUpdatedHandler, handleFirstTime bool) *AutoLoadJSON {
+	j := NewAutoLoadJSON(url, timeout, handler, handleFirstTime)
+	j.Start()
 	return j
 }
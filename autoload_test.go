@@ -0,0 +1,130 @@
+package modern
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type signedDynTest struct {
+	url   string
+	cache string
+	key   ed25519.PrivateKey
+	pub   string
+}
+
+func newSignedDynTest(t *testing.T) *signedDynTest {
+	t.Helper()
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	dir := t.TempDir()
+	return &signedDynTest{
+		url:   filepath.Join(dir, "dyn.json"),
+		cache: filepath.Join(dir, "dyn.cache.json"),
+		key:   key,
+		pub:   hex.EncodeToString(pub),
+	}
+}
+
+func (d *signedDynTest) write(t *testing.T, name string, b []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(name, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (d *signedDynTest) start(t *testing.T, timeout time.Duration) (*AutoLoadJSON, chan error) {
+	t.Helper()
+	v, err := newDynVerifier(d.url, []string{d.pub}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := NewAutoLoadJSON(d.url, time.Hour, nil, false)
+	j.Verify = v.Verify
+	j.CacheFile = d.cache
+	j.StartupTimeout = timeout
+	j.autoLoadFile.Jitter = -1
+	t.Cleanup(func() { j.Close() })
+	res := make(chan error, 1)
+	go func() { res <- j.Start() }()
+	return j, res
+}
+
+func TestAutoLoadJSONRejectedAtStart(t *testing.T) {
+	body := []byte(`{"a":1}`)
+	cached := []byte(`{"a":0}`)
+
+	cases := []struct {
+		name   string
+		cached bool
+		err    string
+		a      string
+	}{
+		{"no cache", false, "loaded data is rejected", ""},
+		{"cache", true, "", "0"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newSignedDynTest(t)
+			if tc.cached {
+				// previous run leaves verified data in the cache
+				d.write(t, d.url+".sig", SignConfDetached(d.key, 1, cached))
+				d.write(t, d.url, cached)
+				j, res := d.start(t, time.Second)
+				if err := <-res; err != nil {
+					t.Fatal(err)
+				}
+				j.Close()
+				d.write(t, d.url+".sig", []byte(`{"version":2,"signature":"bad"}`))
+			}
+			d.write(t, d.url, body) // not signed by the published .sig
+
+			j, res := d.start(t, time.Millisecond*300)
+			err := <-res
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error with %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			o, _ := j.snapshot()
+			if v, _ := decodeJSONBytes(o.ToByteArray(0)); v.(map[string]interface{})["a"].(interface{ String() string }).String() != tc.a || !j.Stale() {
+				t.Fatalf("expected stale cached data, got %s", o.ToByteArray(0))
+			}
+		})
+	}
+}
+
+func TestAutoLoadJSONSignatureAfterBody(t *testing.T) {
+	d := newSignedDynTest(t)
+	body := []byte(`{"a":1}`)
+	d.write(t, d.url, body)
+
+	j, res := d.start(t, 0)
+	time.Sleep(time.Millisecond * 200)
+	select {
+	case err := <-res:
+		t.Fatalf("start should wait for the signature, got %v", err)
+	default:
+	}
+	d.write(t, d.url+".sig", SignConfDetached(d.key, 1, body))
+	j.ReloadNow()
+	select {
+	case err := <-res:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("signature published later is not picked up")
+	}
+	if e := j.LastError(); e != "" || j.Stale() {
+		t.Fatalf("expected verified fresh data, got error %q", e)
+	}
+}
@@ -0,0 +1,77 @@
+package modern
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+/*
+	Version, GoVersion, BuildTime, CodeRev and ModifiedSources of TrivialSetupConf
+	may still be injected with ldflags, but if they are empty
+	they are taken from the build info embedded by go build
+*/
+
+type BuildInfo struct {
+	Module          string `json:"module,omitempty"`
+	Version         string `json:"version"`
+	GoVersion       string `json:"goversion"`
+	BuildTime       string `json:"buildtime"`
+	CodeRev         string `json:"coderev"`
+	Modified        bool   `json:"modified"`
+	ModifiedSources string `json:"modifiedsources,omitempty"`
+}
+
+// what go build has embedded into the binary, fields are empty if it's not available
+func ReadBuildInfo() *BuildInfo {
+	b := &BuildInfo{GoVersion: runtime.Version()}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return b
+	}
+	b.Module = bi.Main.Path
+	if bi.Main.Version != "(devel)" {
+		b.Version = bi.Main.Version
+	}
+	if bi.GoVersion != "" {
+		b.GoVersion = bi.GoVersion
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			b.CodeRev = s.Value
+		case "vcs.time":
+			b.BuildTime = s.Value
+		case "vcs.modified":
+			b.Modified = s.Value == "true"
+		}
+	}
+	return b
+}
+
+// fills empty fields of c with values from embedded build info,
+// returns resulting build info
+func (c *TrivialSetupConf) FillFromBuildInfo(b *BuildInfo) *BuildInfo {
+	F.EnsureNotEmptyString(&c.Version, b.Version)
+	F.EnsureNotEmptyString(&c.GoVersion, b.GoVersion)
+	F.EnsureNotEmptyString(&c.BuildTime, b.BuildTime)
+	F.EnsureNotEmptyString(&c.CodeRev, b.CodeRev)
+	if b.Modified {
+		F.EnsureNotEmptyString(&c.ModifiedSources, "working tree")
+	}
+
+	return &BuildInfo{
+		Module:          b.Module,
+		Version:         c.Version,
+		GoVersion:       c.GoVersion,
+		BuildTime:       c.BuildTime,
+		CodeRev:         c.CodeRev,
+		Modified:        b.Modified || c.ModifiedSources != "",
+		ModifiedSources: c.ModifiedSources,
+	}
+}
+
+func (b *BuildInfo) ToMap() map[string]interface{} {
+	m := map[string]interface{}{}
+	F.JsonClone(b, &m)
+	return m
+}
@@ -0,0 +1,173 @@
+package modern
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// built-in components, http ones are enabled when their url is set in TrivialSetupConf
+const (
+	ComponentConf        = "conf"
+	ComponentHealthPoint = "healthpoint"
+	ComponentVersion     = "version"
+	ComponentConfigDump  = "configdump"
+	ComponentWebsockLogs = "websocklogs"
+	ComponentHeapDump    = "heapdump"
+	ComponentKill        = "kill"
+	ComponentStatic      = "static"
+	ComponentMonitors    = "monitors"
+	ComponentAdmin       = "admin"
+)
+
+func (a *App) registerBuiltinComponents() {
+	c := a.Conf
+
+	a.Components.Register(&ComponentFuncs{
+		ComponentName: ComponentConf,
+		StartFunc: func(ctx context.Context) error {
+			if err := a.ModernConf.LoadAll(); err != nil {
+				return &SetupError{StageConf, "failed to load configuration", err}
+			}
+			return nil
+		},
+		HealthFunc: func() interface{} {
+			return a.ModernConf.Health()
+		},
+	})
+
+	if c == nil {
+		return
+	}
+
+	// admin api works in headless mode too, see App.setupHttp
+	if good(c.AdminURL) && c.AdminToken == "" {
+		a.Log.Warn("admin api is disabled: AdminToken is not set")
+	} else if good(c.AdminURL) {
+		a.Components.Register(&ComponentFuncs{
+			ComponentName: ComponentAdmin,
+			InitFunc: func(app *App) error {
+				RegisterSecret(c.AdminToken)
+				audit := &auditLog{file: c.AdminAuditLog, log: app.ModernConf.Log, errorLog: app.ModernConf.ErrorLog}
+				if audit.file == "" && c.LogsPath != "-" {
+					audit.file = c.LogsPath + "/" + app.FullName + ".audit.log"
+				} else if audit.file == "-" {
+					audit.file = ""
+				}
+				app.attachAdminHandlers(audit)
+				return nil
+			},
+		})
+	}
+
+	if c.Headless {
+		return
+	}
+
+	if good(c.WebsocketLogsRoot) {
+		a.Components.Register(&ComponentFuncs{
+			ComponentName: ComponentWebsockLogs,
+			InitFunc: func(app *App) error {
+				SetupWebsockLogHandler(&WebsockLogHandler{Router: app.Router, LogsUrlRoot: c.WebsocketLogsRoot, Logger: app.LogConf})
+				return nil
+			},
+		})
+	}
+
+	if good(c.HeapDumpUrl) {
+		a.Components.Register(&ComponentFuncs{
+			ComponentName: ComponentHeapDump,
+			InitFunc: func(app *App) error {
+				snapshotsFolder := app.F.AppendSlash(c.StaticContentRoot) + "heapdumps"
+				os.MkdirAll(snapshotsFolder, 755)
+				AttachHeapDumpHandler(app.Router, c.HeapDumpUrl, snapshotsFolder, c.StaticContentRootURL+"heapdumps")
+				return nil
+			},
+		})
+	}
+
+	if good(c.KillUrl) {
+		a.Components.Register(&ComponentFuncs{
+			ComponentName: ComponentKill,
+			InitFunc: func(app *App) error {
+				AttachShutdownHandlerFunc(app.Router, c.KillUrl, app.interrupt)
+				return nil
+			},
+		})
+	}
+
+	if good(c.StaticContentRootURL) {
+		a.Components.Register(&ComponentFuncs{
+			ComponentName: ComponentStatic,
+			InitFunc: func(app *App) error {
+				AttachSubdirFileServer(app.Router, c.StaticContentRootURL, c.StaticContentRoot)
+				return nil
+			},
+		})
+	}
+
+	if good(c.MonitorsUrl) {
+		a.Components.Register(&ComponentFuncs{
+			ComponentName: ComponentMonitors,
+			InitFunc: func(app *App) error {
+				app.Router.GET(c.MonitorsUrl, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+					//monitor.DefaultStore.ServeHTTP(w, r)
+					w.Write([]byte("monitors not available"))
+				})
+				return nil
+			},
+		})
+	}
+
+	if good(c.VersionURL) {
+		a.Components.Register(&ComponentFuncs{
+			ComponentName: ComponentVersion,
+			InitFunc: func(app *App) error {
+				app.Router.GET(c.VersionURL, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+					w.Header().Set("Content-Type", "application/json")
+					w.Write(app.F.ToJsonBytes(app.BuildInfo))
+				})
+				return nil
+			},
+		})
+	}
+
+	if good(c.ConfigDumpURL) && c.AdminToken == "" {
+		a.Log.Warn("config dump is disabled: AdminToken is not set")
+	} else if good(c.ConfigDumpURL) {
+		a.Components.Register(&ComponentFuncs{
+			ComponentName: ComponentConfigDump,
+			InitFunc: func(app *App) error {
+				RegisterSecret(c.AdminToken)
+				app.Router.GET(c.ConfigDumpURL, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+					// values are masked only by key names, so the dump is for admins only
+					if !app.adminAuthorized(r) {
+						app.Log.Warn("unauthorized config dump request from ", r.RemoteAddr)
+						writeAdminError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+						return
+					}
+					w.Header().Set("Content-Type", "application/json")
+					w.Write(app.F.ToJsonBytes(app.ConfigReport()))
+				})
+				return nil
+			},
+		})
+	}
+
+	if good(c.HealthPointURL) {
+		a.Components.Register(&ComponentFuncs{
+			ComponentName: ComponentHealthPoint,
+			InitFunc: func(app *App) error {
+				app.Router.GET(c.HealthPointURL, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+					app.HealthPoint.Put("memstats", GetSomeMemStats())
+					app.HealthPoint.Put("components", app.Components.Health())
+					w.Write([]byte(RedactSecrets(string(app.HealthPoint.ToByteArray(2)))))
+				})
+				return nil
+			},
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package modern
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	interrupts "github.com/rshmelev/go-inthandler"
+	"github.com/rshmelev/installasservice"
+	"github.com/rshmelev/restarter/librestarter"
+)
+
+/*
+	special (maintenance) commands like __installservice, __phoenix, -v ...
+	the app runs the command instead of its normal work and exits with command's exit code.
+
+	modern.RegisterCommand(&modern.Command{
+		Name:       "__migrate",
+		Help:       "apply db migrations and exit",
+		AfterSetup: true,
+		Run: func(app *modern.App, args []string) int {
+			...
+			return modern.ExitOk
+		},
+	})
+*/
+
+// exit codes of commands
+const (
+	ExitOk      = 0
+	ExitFailure = 1
+	ExitUsage   = 2
+)
+
+type CommandFunc func(app *App, args []string) int
+
+type Command struct {
+	// "__something" may be anywhere in args, "-something" must be the first arg
+	Name string
+	// arg only has to start with Name, like __is_for_production=1
+	Prefix bool
+	Help   string
+	// false: run right after env is loaded (no logs, no conf yet)
+	// true: run after App is fully set up
+	AfterSetup bool
+	Run        CommandFunc
+}
+
+type CommandRegistry struct {
+	mutex    sync.Mutex
+	commands map[string]*Command
+}
+
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{commands: map[string]*Command{}}
+}
+
+// framework commands + commands that are shared by all apps of the process
+var DefaultCommands = NewCommandRegistry()
+
+func RegisterCommand(cmd *Command) {
+	DefaultCommands.Register(cmd)
+}
+
+// command with the same name is replaced
+func (r *CommandRegistry) Register(cmd *Command) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.commands[cmd.Name] = cmd
+}
+
+func (r *CommandRegistry) Get(name string) *Command {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.commands[name]
+}
+
+func (r *CommandRegistry) All() []*Command {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	res := make([]*Command, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		res = append(res, cmd)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// looks for command in args, returns it with args that follow it
+func (r *CommandRegistry) Find(args []string) (*Command, []string) {
+	for i, arg := range args {
+		if i > 0 && !strings.HasPrefix(arg, "__") {
+			continue
+		}
+		if cmd := r.Get(arg); cmd != nil {
+			return cmd, args[i+1:]
+		}
+		for _, cmd := range r.All() {
+			if cmd.Prefix && strings.HasPrefix(arg, cmd.Name) {
+				return cmd, args[i+1:]
+			}
+		}
+	}
+	return nil, nil
+}
+
+//=======================================================================
+
+// app commands first, then DefaultCommands
+func (a *App) findCommand() (*Command, []string) {
+	if cmd, rest := a.Commands.Find(a.args); cmd != nil {
+		return cmd, rest
+	}
+	return DefaultCommands.Find(a.args)
+}
+
+// runs command requested in args (if any) and exits the process
+func (a *App) probablyRunCommand(afterSetup bool) {
+	if !a.processIntegration {
+		return
+	}
+	cmd, rest := a.findCommand()
+	if cmd == nil || cmd.AfterSetup != afterSetup || cmd.Run == nil {
+		return
+	}
+	code := cmd.Run(a, rest)
+	if a.Log != nil {
+		a.Log.Flush()
+	}
+	os.Exit(code)
+}
+
+func (a *App) commandsHelp() string {
+	seen := map[string]bool{}
+	list := []*Command{}
+	for _, cmd := range append(a.Commands.All(), DefaultCommands.All()...) {
+		if !seen[cmd.Name] {
+			seen[cmd.Name] = true
+			list = append(list, cmd)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	s := a.FullAppString + "\n\nspecial commands:\n"
+	for _, cmd := range list {
+		s += "  " + cmd.Name + strings.Repeat(" ", maxInt(1, 22-len(cmd.Name))) + cmd.Help + "\n"
+	}
+	return s
+}
+
+// restarter process (__phoenix) and its children use the same options,
+// the library is called by every process to let children talk to the restarter
+func (a *App) restarterOptions() librestarter.RestarterOptions {
+	shutdownUrl := "http://" + a.Conf.HttpBind + a.Conf.KillUrl
+	if a.Conf.Headless {
+		shutdownUrl = ""
+	}
+	return librestarter.RestarterOptions{
+		ShutdownURL:             shutdownUrl,
+		MaxTimeToWaitForCleanup: &interrupts.MaxTimeToWaitForCleanup,
+		Stop:                    interrupts.StopPointer,
+		StopChannel:             interrupts.StopChannel,
+	}
+}
+
+// ExitFailure with the reason if f panics
+func runWithRecover(name string, f func() int) (code int) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintln(os.Stderr, name+" failed:", r)
+			code = ExitFailure
+		}
+	}()
+	return f()
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name: "__help",
+		Help: "list special commands",
+		Run: func(app *App, args []string) int {
+			print(app.commandsHelp())
+			return ExitOk
+		},
+	})
+	RegisterCommand(&Command{
+		Name: "-v",
+		Help: "print version",
+		Run: func(app *App, args []string) int {
+			println(app.FullAppString)
+			return ExitOk
+		},
+	})
+	RegisterCommand(&Command{
+		Name:   "__is_for_production",
+		Prefix: true,
+		Help:   "print whether this build is for production, exit code 0 if it is",
+		Run: func(app *App, args []string) int {
+			if app.Conf.IsForProduction {
+				println("true")
+				return ExitOk
+			}
+			println("false")
+			return ExitFailure
+		},
+	})
+	RegisterCommand(&Command{
+		Name: "__installservice",
+		Help: "install the app as system service",
+		Run: func(app *App, args []string) int {
+			return runWithRecover("__installservice", func() int {
+				// the installer exits by itself when it has done its job
+				installasservice.ProbablyInstallAsService(&installasservice.ServiceInstallerOptions{
+					MaxShutdownTime: interrupts.MaxTimeToWaitForCleanup,
+					AppName:         app.Conf.AppName,
+					CompanyName:     app.Conf.CompanyName,
+				})
+				fmt.Fprintln(os.Stderr, "__installservice: service has not been installed")
+				return ExitFailure
+			})
+		},
+	})
+	RegisterCommand(&Command{
+		Name: "__phoenix",
+		Help: "become restarter: run the app as a child process and restart it when it dies",
+		Run: func(app *App, args []string) int {
+			// restarter has already run (see setupEnv), it returns only when it can't work or is stopped
+			if Stop {
+				return ExitOk
+			}
+			fmt.Fprintln(os.Stderr, "__phoenix: restarter has exited unexpectedly")
+			return ExitFailure
+		},
+	})
+}
@@ -0,0 +1,230 @@
+package modern
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+/*
+	components are parts of the app with common lifecycle:
+	Init is called during setup (routes, objects), Start - when app starts,
+	Stop - on shutdown in reverse start order, Health is reported via healthpoint.
+
+	app.Register(&modern.ComponentFuncs{
+		ComponentName: "cache",
+		Deps:          []string{"conf"},
+		StartFunc:     func(ctx context.Context) error { return cache.Warmup() },
+	})
+*/
+
+type Component interface {
+	Name() string
+	Init(app *App) error
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+	// nil means nothing to report
+	Health() interface{}
+}
+
+// components may implement it to be initialized/started after their dependencies
+type ComponentWithDeps interface {
+	DependsOn() []string
+}
+
+// adapter to build components from functions, any func may be nil
+type ComponentFuncs struct {
+	ComponentName string
+	Deps          []string
+	InitFunc      func(app *App) error
+	StartFunc     func(ctx context.Context) error
+	StopFunc      func(ctx context.Context) error
+	HealthFunc    func() interface{}
+}
+
+func (c *ComponentFuncs) Name() string {
+	return c.ComponentName
+}
+
+func (c *ComponentFuncs) DependsOn() []string {
+	return c.Deps
+}
+
+func (c *ComponentFuncs) Init(app *App) error {
+	if c.InitFunc == nil {
+		return nil
+	}
+	return c.InitFunc(app)
+}
+
+func (c *ComponentFuncs) Start(ctx context.Context) error {
+	if c.StartFunc == nil {
+		return nil
+	}
+	return c.StartFunc(ctx)
+}
+
+func (c *ComponentFuncs) Stop(ctx context.Context) error {
+	if c.StopFunc == nil {
+		return nil
+	}
+	return c.StopFunc(ctx)
+}
+
+func (c *ComponentFuncs) Health() interface{} {
+	if c.HealthFunc == nil {
+		return nil
+	}
+	return c.HealthFunc()
+}
+
+//=======================================================================
+
+type ComponentRegistry struct {
+	mutex      sync.Mutex
+	components map[string]Component
+	order      []string // registration order
+	inited     map[string]bool
+	started    map[string]bool
+}
+
+func NewComponentRegistry() *ComponentRegistry {
+	return &ComponentRegistry{
+		components: map[string]Component{},
+		inited:     map[string]bool{},
+		started:    map[string]bool{},
+	}
+}
+
+func (r *ComponentRegistry) Register(c Component) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	name := c.Name()
+	if name == "" {
+		return errors.New("component name can't be empty")
+	}
+	if _, ok := r.components[name]; ok {
+		return errors.New("component is already registered: " + name)
+	}
+	r.components[name] = c
+	r.order = append(r.order, name)
+	return nil
+}
+
+func (r *ComponentRegistry) Get(name string) Component {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.components[name]
+}
+
+// all components, dependencies first, otherwise in registration order
+func (r *ComponentRegistry) Sorted() ([]Component, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	res := make([]Component, 0, len(r.order))
+	state := map[string]int{} // 1 = visiting, 2 = done
+	var visit func(name string, from string) error
+	visit = func(name string, from string) error {
+		c, ok := r.components[name]
+		if !ok {
+			return errors.New("component " + from + " depends on unknown component " + name)
+		}
+		switch state[name] {
+		case 1:
+			return errors.New("dependency cycle detected at component " + name)
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		if d, ok := c.(ComponentWithDeps); ok {
+			for _, dep := range d.DependsOn() {
+				if err := visit(dep, name); err != nil {
+					return err
+				}
+			}
+		}
+		state[name] = 2
+		res = append(res, c)
+		return nil
+	}
+
+	for _, name := range r.order {
+		if err := visit(name, ""); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// inits components that were not initialized yet
+func (r *ComponentRegistry) InitAll(app *App) error {
+	sorted, err := r.Sorted()
+	if err != nil {
+		return err
+	}
+	for _, c := range sorted {
+		if r.marked(r.inited, c.Name()) {
+			continue
+		}
+		if err := c.Init(app); err != nil {
+			return fmt.Errorf("failed to init component %s: %w", c.Name(), err)
+		}
+		r.mark(r.inited, c.Name())
+	}
+	return nil
+}
+
+// starts components that were not started yet, Stop of each started component
+// is registered as shutdown hook so they are stopped in reverse order
+func (r *ComponentRegistry) StartAll(ctx context.Context, lifecycle *Lifecycle) error {
+	sorted, err := r.Sorted()
+	if err != nil {
+		return err
+	}
+	for _, c := range sorted {
+		if r.marked(r.started, c.Name()) {
+			continue
+		}
+		if err := c.Start(ctx); err != nil {
+			return fmt.Errorf("failed to start component %s: %w", c.Name(), err)
+		}
+		r.mark(r.started, c.Name())
+		if lifecycle != nil {
+			lifecycle.OnShutdown(c.Name(), c.Stop)
+		}
+	}
+	return nil
+}
+
+// health of components that have something to report
+func (r *ComponentRegistry) Health() map[string]interface{} {
+	r.mutex.Lock()
+	list := make([]Component, 0, len(r.order))
+	for _, name := range r.order {
+		list = append(list, r.components[name])
+	}
+	r.mutex.Unlock()
+
+	res := map[string]interface{}{}
+	for _, c := range list {
+		if h := c.Health(); h != nil {
+			res[c.Name()] = h
+		}
+	}
+	return res
+}
+
+// component is marked only when its Init/Start succeeded, so failed one is retried next time
+func (r *ComponentRegistry) marked(m map[string]bool, name string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return m[name]
+}
+
+func (r *ComponentRegistry) mark(m map[string]bool, name string) {
+	r.mutex.Lock()
+	m[name] = true
+	r.mutex.Unlock()
+}
@@ -1,9 +1,12 @@
 package modern
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"log"
+	"os"
+	"reflect"
+	"sync"
 
 	js "github.com/rshmelev/go-json-light"
 
@@ -35,26 +38,78 @@ type ModernConf struct {
 	AppName string
 
 	LocalConfFile string
-	local         js.IObject
+	local         js.IObject // guarded by localMutex
+	localMutex    sync.RWMutex
+	// LocalConfFile is watched and reloaded on change, see filewatch.go
+	LocalHotReload     bool
+	LocalUpdateHandler DynamicConfigurationUpdateHandler
+	localWatch         *AutoLoadJSON
 
 	dyn              *AutoLoadJSON
 	DynConfUrl       string
 	DynUpdatePeriod  time.Duration
 	DynUpdateHandler DynamicConfigurationUpdateHandler
+	DynDiffHandler   DynDiffHandler
+	// ed25519 public keys, if set dyn must be signed, see dynsign.go
+	DynSigningKeys []string
+	// last known good dyn is kept there (confdir/dyn.cache.json by default, "-" disables it)
+	// and used if DynConfUrl is not available or rejected at start.
+	// LoadAll waits for dyn for DynStartupTimeout (30s if the cache exists, forever otherwise),
+	// then falls back to the cache or fails
+	DynCacheFile      string
+	DynStartupTimeout time.Duration
+	// retry backoff of dyn and local hot reload, see AutoLoadFile.MaxBackoff and Jitter
+	DynMaxBackoff time.Duration
+	DynJitter     float64
 	// dyn             js.IObject
 	// dynMutex        sync.Mutex
 
 	StateFile       string
 	StateSavePeriod time.Duration
-	state           *js.SynchronizedObjectWrapper
+	state           *js.SynchronizedObjectWrapper // set by LoadAll, see stateMutex
 
 	ConfLoadTimeout time.Duration
 
 	Log      SimpleLogFunc
 	ErrorLog SimpleLogFunc
 
+	// if set, state saver and dyn autoloader register their shutdown hooks here
+	Lifecycle *Lifecycle
+
+	// the lowest layer of Merged(), see confoverlay.go
+	Defaults map[string]interface{}
+
+	// if set, string values of local are expanded as templates
+	Templates *TemplateData
+	// dyn is expanded too, only for trusted DynConfUrl: its templates can read env of the app
+	ExpandDynTemplates bool
+
+	// json schemas (file, url or schema itself), see schema.go
+	DynSchema   string
+	LocalSchema string
+	StateSchema string
+
 	//--- aux
 
+	dynBindings      confBindings
+	localBindings    confBindings
+	dynSubscriptions confSubscriptions
+	overlayCache     confOverlayCache
+
+	dynSchema   *schemaValidator
+	localSchema *schemaValidator
+	stateSchema *schemaValidator
+	stateFormat string
+
+	stateSaverDone   chan struct{}
+	stateSaverExited chan struct{}
+	stateSaverOnce   sync.Once
+	stateSaveError   string // last logged save error, guarded by stateErrorMutex
+	stateErrorMutex  sync.Mutex
+	stateSaveMutex   sync.Mutex
+	stateUpdateMutex sync.Mutex   // one UpdateState at a time
+	stateMutex       sync.RWMutex // guards state pointer
+
 	lastDynBody      []byte
 	failedLoadingDyn bool
 }
@@ -79,6 +134,10 @@ func SetupConf(confdir string, basicConfiguration ...*ModernConf) *ModernConf {
 		proto.StateFile = ""
 	}
 	F.EnsureNotEmptyString(&proto.StateFile, confdir+"state.json")
+	if proto.DynCacheFile == "default" {
+		proto.DynCacheFile = ""
+	}
+	F.EnsureNotEmptyString(&proto.DynCacheFile, confdir+"dyn.cache.json")
 
 	F.EnsureNotEmptyDuration(&proto.DynUpdatePeriod, time.Second*5)
 	F.EnsureNotEmptyDuration(&proto.ConfLoadTimeout, time.Second*15)
@@ -99,46 +158,308 @@ func SetupConf(confdir string, basicConfiguration ...*ModernConf) *ModernConf {
 	return proto
 }
 
+// expands templates and resolves secret references of loaded local json
+func (c *ModernConf) prepareJSON(j js.IObject) (js.IObject, error) {
+	var err error
+	if c.Templates != nil {
+		if j, err = c.Templates.ExpandJSON(j); err != nil {
+			return nil, err
+		}
+	}
+	return resolveJSONSecrets(j)
+}
+
 func (c *ModernConf) Dyn() js.IReadonlyObject {
 	return c.dyn.Data() // ToReadonlyObject()
 }
 
+// nil if local is not loaded
 func (c *ModernConf) Local() js.IReadonlyObject {
+	if c.localWatch != nil {
+		o, _ := c.localWatch.snapshot()
+		return o
+	}
+	c.localMutex.RLock()
+	defer c.localMutex.RUnlock()
+	if c.local == nil {
+		return nil
+	}
 	return c.local.ToReadonlyObject()
 }
 
+// current state, the same object for the whole life of the app
 func (c *ModernConf) State() js.IObject {
-	return js.IObject(c.state)
+	return js.IObject(c.currentState())
 }
 
-func (c *ModernConf) SaveStateStep() {
+func (c *ModernConf) currentState() *js.SynchronizedObjectWrapper {
+	c.stateMutex.RLock()
+	defer c.stateMutex.RUnlock()
+	return c.state
+}
+
+// fn changes a copy of state, the copy is validated and saved, and only then
+// its changes are applied to the current state (the object State() returns).
+// error of fn, validation or saving leaves current state as is
+func (c *ModernConf) UpdateState(fn func(state js.IObject) error) (js.IObject, error) {
+	return c.changeState(func(cur js.IObject) (js.IObject, error) {
+		next, err := js.NewObjectFromBytes(cur.ToByteArray(0))
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(next); err != nil {
+			return nil, err
+		}
+		return next, nil
+	})
+}
+
+// go-json-light objects that can drop keys
+type jsonKeyRemover interface {
+	Remove(key string)
+}
+
+func (c *ModernConf) changeState(build func(cur js.IObject) (js.IObject, error)) (js.IObject, error) {
+	c.stateUpdateMutex.Lock()
+	defer c.stateUpdateMutex.Unlock()
+	cur := c.currentState()
+	if cur == nil {
+		return nil, errors.New("state is not loaded")
+	}
+	oldv, err := decodeJSONBytes(cur.ToByteArray(0))
+	if err != nil {
+		return nil, err
+	}
+	next, err := build(cur)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.stateSchema.Validate(next); err != nil {
+		return nil, err
+	}
+	newv, err := decodeJSONBytes(next.ToByteArray(0))
+	if err != nil {
+		return nil, err
+	}
+	oldm, _ := oldv.(map[string]interface{})
+	newm, ok := newv.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("state has to be an object")
+	}
+	remover, canRemove := js.IObject(cur).(jsonKeyRemover)
+	for k := range oldm {
+		if _, ok := newm[k]; !ok && !canRemove {
+			return nil, errors.New("state object can't remove keys, cannot remove " + k)
+		}
+	}
+
+	// saver must not write the old state after the new one
+	c.stateSaveMutex.Lock()
+	defer c.stateSaveMutex.Unlock()
+	if err := c.writeState(next); err != nil {
+		return nil, err
+	}
+	// keys that weren't touched keep values put there meanwhile
+	for k, v := range newm {
+		if old, ok := oldm[k]; !ok || !reflect.DeepEqual(old, v) {
+			cur.Put(k, v)
+		}
+	}
+	for k := range oldm {
+		if _, ok := newm[k]; !ok {
+			remover.Remove(k)
+		}
+	}
+	return cur, nil
+}
+
+// status of configuration for healthpoint
+func (c *ModernConf) Health() map[string]interface{} {
+	h := map[string]interface{}{
+		"loaded": c.dyn != nil,
+	}
+	if c.dyn != nil {
+		h["dynfailing"] = c.dyn.Failing()
+		h["dynstale"] = c.dyn.Stale()
+		h["dynsigned"] = c.dyn.Verify != nil
+		if e := c.dyn.LastError(); e != "" {
+			h["dynerror"] = e
+		}
+	}
+	return h
+}
+
+// same error is logged once, not every StateSavePeriod
+func (c *ModernConf) saveStateLogged() {
 	err := c.SaveState()
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	c.stateErrorMutex.Lock()
+	last := c.stateSaveError
+	c.stateSaveError = msg
+	c.stateErrorMutex.Unlock()
+	if msg == last {
+		return
+	}
 	if err != nil {
-		c.ErrorLog("failed to save state to file: ", c.StateFile)
+		c.ErrorLog("failed to save state to file: ", c.StateFile, ", error: ", err)
+	} else {
+		c.Log("state is saved again: " + c.StateFile)
 	}
-	time.Sleep(c.StateSavePeriod)
-	go c.SaveStateStep()
+}
+
+// saves state and keeps saving it every StateSavePeriod until Close, blocks.
+// LoadAll does the same in background, if its loop is running SaveStateStep only saves once
+func (c *ModernConf) SaveStateStep() {
+	c.saveStateLogged()
+	if done, exited, ok := c.claimStateSaver(); ok {
+		c.stateSaverLoop(done, exited)
+	}
+}
+
+// ok if the caller has to run the saver loop: it is not running yet and not stopped
+func (c *ModernConf) claimStateSaver() (done, exited chan struct{}, ok bool) {
+	c.stateSaveMutex.Lock()
+	defer c.stateSaveMutex.Unlock()
+	if c.stateSaverDone != nil {
+		return nil, nil, false
+	}
+	c.stateSaverDone = make(chan struct{})
+	c.stateSaverExited = make(chan struct{})
+	return c.stateSaverDone, c.stateSaverExited, true
+}
+
+func (c *ModernConf) stateSaverLoop(done <-chan struct{}, exited chan struct{}) {
+	defer close(exited)
+	t := time.NewTicker(c.StateSavePeriod)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			c.saveStateLogged()
+		}
+	}
+}
+
+// stops state saving loop and saves state for the last time
+func (c *ModernConf) stopStateSaver() error {
+	c.stateSaveMutex.Lock()
+	done, exited := c.stateSaverDone, c.stateSaverExited
+	if done == nil {
+		// loop has never been started, it must not start after Close
+		closed := make(chan struct{})
+		close(closed)
+		c.stateSaverDone, c.stateSaverExited = closed, closed
+		c.stateSaverOnce.Do(func() {})
+		c.stateSaveMutex.Unlock()
+		return nil
+	}
+	c.stateSaveMutex.Unlock()
+	stopped := false
+	c.stateSaverOnce.Do(func() {
+		close(done)
+		<-exited
+		stopped = true
+	})
+	if !stopped {
+		return nil
+	}
+	return c.SaveState()
+}
+
+// stops all loops of configuration, state is saved.
+// called on app shutdown if Lifecycle is set
+func (c *ModernConf) Close() error {
+	if c.localWatch != nil {
+		c.localWatch.Close()
+	}
+	if c.dyn != nil {
+		c.dyn.Close()
+	}
+	return c.stopStateSaver()
+}
+
+// loads dyn right away instead of waiting for DynUpdatePeriod
+func (c *ModernConf) ReloadDyn() error {
+	if c.dyn == nil {
+		return errors.New("configuration is not loaded")
+	}
+	return c.dyn.LoadNow()
 }
 
 func (c *ModernConf) SaveState() error {
-	b := c.state.ToByteArray(2)
-	err := F.SafeWriteFile(c.StateFile, b)
+	c.stateSaveMutex.Lock()
+	defer c.stateSaveMutex.Unlock()
+	state := c.currentState()
+	if err := c.stateSchema.Validate(state); err != nil {
+		return errors.New("state is not saved: " + err.Error())
+	}
+	return c.writeState(state)
+}
+
+func (c *ModernConf) writeState(state js.IReadonlyObject) error {
+	b, err := JSONToConf(c.stateFormat, state.ToByteArray(2))
+	if err != nil {
+		return err
+	}
+	return F.SafeWriteFile(c.StateFile, b)
+}
+
+func (c *ModernConf) loadSchemas() error {
+	var err error
+	if c.dynSchema, err = loadSchema(c.DynSchema, c.ConfLoadTimeout); err != nil {
+		return err
+	}
+	if c.localSchema, err = loadSchema(c.LocalSchema, c.ConfLoadTimeout); err != nil {
+		return err
+	}
+	c.stateSchema, err = loadSchema(c.StateSchema, c.ConfLoadTimeout)
 	return err
 }
 
 func (c *ModernConf) LoadAll() error {
+	if err := c.loadSchemas(); err != nil {
+		return err
+	}
 
 	if c.LocalConfFile != "" && c.LocalConfFile != "-" {
 		var err error
-		var code int
 
 		c.Log("loading local configuration... ")
-		c.local, err, code = js.NewObjectFromFile(c.LocalConfFile, c.ConfLoadTimeout)
-		if err != nil {
-			return err
-		}
-		if code != 200 {
-			return errors.New(fmt.Sprint("got sad HTTP code ", code, " while loading local conf"))
+		if c.LocalHotReload {
+			// the only load of local, Start doesn't handle unchanged file again
+			c.localWatch = NewAutoLoadJSON(c.LocalConfFile, c.DynUpdatePeriod, c.localUpdated, false)
+			c.localWatch.Transform = c.transformLocal
+			c.localWatch.autoLoadFile.FetchTimeout = c.ConfLoadTimeout
+			c.localWatch.autoLoadFile.MaxBackoff = c.DynMaxBackoff
+			c.localWatch.autoLoadFile.Jitter = c.DynJitter
+			if err = c.localWatch.LoadNow(); err != nil {
+				return err
+			}
+			if e := c.localWatch.LastError(); e != "" {
+				return errors.New("local conf " + c.LocalConfFile + ": " + e)
+			}
+			c.localWatch.Start()
+			if c.Lifecycle != nil {
+				c.Lifecycle.OnShutdown("local autoloader", func(ctx context.Context) error {
+					return c.localWatch.Close()
+				})
+			}
+		} else {
+			local, _, err := LoadConfObject(c.LocalConfFile, c.ConfLoadTimeout)
+			if err != nil {
+				return err
+			}
+			if local, err = c.transformLocal(local); err != nil {
+				return errors.New("local conf " + c.LocalConfFile + ": " + err.Error())
+			}
+			c.localMutex.Lock()
+			c.local = local
+			c.localMutex.Unlock()
 		}
 	}
 
@@ -147,21 +468,78 @@ func (c *ModernConf) LoadAll() error {
 
 		c.Log("loading state... ")
 		var prestate js.IObject
-		prestate, err, _ = js.NewObjectFromFile(c.StateFile, c.ConfLoadTimeout)
+		prestate, c.stateFormat, err = LoadConfObject(c.StateFile, c.ConfLoadTimeout)
+		if err == nil {
+			// clear state would overwrite the file, so it is left for someone to fix it
+			if err = c.stateSchema.Validate(prestate); err != nil {
+				return errors.New("state " + c.StateFile + " doesn't match the schema: " + err.Error())
+			}
+		}
 		if err != nil {
 			prestate = js.NewEmptyObject()
+			c.stateFormat = DetectConfFormat(c.StateFile, "")
 			c.ErrorLog("WARNING: failed to load state ("+c.StateFile+"), will start with clear state, error was: ", err)
 		}
-		c.state, _ = js.GetSynchronizedWrapper(prestate).(*js.SynchronizedObjectWrapper)
+		state, ok := js.GetSynchronizedWrapper(prestate).(*js.SynchronizedObjectWrapper)
+		if !ok {
+			return errors.New("cannot wrap state " + c.StateFile)
+		}
+		c.stateMutex.Lock()
+		c.state = state
+		c.stateMutex.Unlock()
 		c.Log("starting state saving loop... ")
-		go c.SaveStateStep()
+		if done, exited, ok := c.claimStateSaver(); ok {
+			go c.stateSaverLoop(done, exited)
+		}
+
+		if c.Lifecycle != nil {
+			c.Lifecycle.OnShutdown("state saver", func(ctx context.Context) error {
+				return c.stopStateSaver()
+			})
+		}
 	}
 
-	c.dyn = StartAutoLoadingJSON(c.DynConfUrl, c.DynUpdatePeriod, func(oldj, newj js.IReadonlyObject) {
-		if c.DynUpdateHandler != nil {
-			c.DynUpdateHandler(c, oldj)
+	verifier, err := newDynVerifier(c.DynConfUrl, c.DynSigningKeys, c.ConfLoadTimeout)
+	if err != nil {
+		return err
+	}
+	c.dyn = NewAutoLoadJSON(c.DynConfUrl, c.DynUpdatePeriod, c.dynUpdated, false)
+	c.dyn.Transform = c.transformDyn
+	c.dyn.CacheFile = c.DynCacheFile
+	c.dyn.StartupTimeout = c.DynStartupTimeout
+	if c.dyn.StartupTimeout == 0 && c.DynCacheFile != "" && c.DynCacheFile != "-" {
+		// without cache there is nothing to fall back to, so it waits forever as before
+		if _, err := os.Stat(c.DynCacheFile); err == nil {
+			c.dyn.StartupTimeout = time.Second * 30
 		}
-	}, false)
+	}
+	c.dyn.autoLoadFile.FetchTimeout = c.ConfLoadTimeout
+	c.dyn.autoLoadFile.MaxBackoff = c.DynMaxBackoff
+	c.dyn.autoLoadFile.Jitter = c.DynJitter
+	if verifier != nil {
+		c.dyn.Verify = verifier.Verify
+	}
+	if err := c.dyn.Start(); err != nil {
+		return err
+	}
+	if e := c.dyn.LastError(); e != "" {
+		return errors.New("dyn conf " + c.DynConfUrl + ": " + e)
+	}
+
+	if c.Lifecycle != nil {
+		c.Lifecycle.OnShutdown("dyn autoloader", func(ctx context.Context) error {
+			return c.dyn.Close()
+		})
+	}
+
+	env, err := envOverrides(c.AppName)
+	if err != nil {
+		return err
+	}
+	c.overlayCache.mutex.Lock()
+	c.overlayCache.env = env
+	c.overlayCache.overlay = nil
+	c.overlayCache.mutex.Unlock()
 
 	c.Log("configuration has been loaded")
 
@@ -0,0 +1,189 @@
+package modern
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/rshmelev/go-initstruct"
+	js "github.com/rshmelev/go-json-light"
+)
+
+/*
+	dyn and local json bound to go structs:
+
+	type MyDyn struct {
+		Workers int `json:"workers" init:"4" validate:"min=1"`
+	}
+	dyn, err := conf.BindDyn(&MyDyn{})
+	...
+	workers := dyn.Get().(*MyDyn).Workers
+
+	defaults are the values of given struct plus `init` tags.
+	every update of dyn.json is decoded into a fresh struct and validated (see validate.go),
+	invalid update is rejected as a whole: json and all bound structs keep previous values.
+	bound structs are swapped atomically and must not be modified by readers
+*/
+
+type ConfBindingUpdateHandler func(old, new interface{})
+
+type ConfBinding struct {
+	Name     string // dyn or local
+	OnUpdate ConfBindingUpdateHandler
+
+	typ      reflect.Type
+	defaults []byte
+	value    atomic.Value
+}
+
+// current value, pointer to struct of the type that was bound
+func (b *ConfBinding) Get() interface{} {
+	return b.value.Load()
+}
+
+func newConfBinding(name string, proto interface{}) (*ConfBinding, error) {
+	t := reflect.TypeOf(proto)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return nil, errors.New("pointer to struct is expected for " + name + " binding")
+	}
+	defaults, err := json.Marshal(proto)
+	if err != nil {
+		return nil, err
+	}
+	b := &ConfBinding{Name: name, typ: t.Elem(), defaults: defaults}
+	v, err := b.decode(nil)
+	if err != nil {
+		return nil, err
+	}
+	b.value.Store(v)
+	return b, nil
+}
+
+// fresh struct with defaults, filled from j and validated
+func (b *ConfBinding) decode(j js.IReadonlyObject) (interface{}, error) {
+	v := reflect.New(b.typ).Interface()
+	if err := json.Unmarshal(b.defaults, v); err != nil {
+		return nil, err
+	}
+	InitZeroFieldsRecursively(v)
+	if j == nil {
+		return v, nil
+	}
+	if err := json.Unmarshal(j.ToByteArray(0), v); err != nil {
+		return nil, err
+	}
+	if err := ValidateStruct(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// set of bindings of one json that is updated all at once
+type confBindings struct {
+	mutex    sync.Mutex
+	bindings []*ConfBinding
+}
+
+func (s *confBindings) add(b *ConfBinding) {
+	s.mutex.Lock()
+	s.bindings = append(s.bindings, b)
+	s.mutex.Unlock()
+}
+
+// decodes j into every binding, swaps values only if all of them are valid
+func (s *confBindings) update(j js.IReadonlyObject) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	values := make([]interface{}, len(s.bindings))
+	for i, b := range s.bindings {
+		v, err := b.decode(j)
+		if err != nil {
+			return errors.New("invalid " + b.Name + " for " + b.typ.String() + ": " + err.Error())
+		}
+		values[i] = v
+	}
+	for i, b := range s.bindings {
+		old := b.value.Load()
+		b.value.Store(values[i])
+		if b.OnUpdate != nil {
+			b.OnUpdate(old, values[i])
+		}
+	}
+	return nil
+}
+
+//=======================================================================
+
+// binds dyn json to struct of the same type as proto, see Get
+func (c *ModernConf) BindDyn(proto interface{}) (*ConfBinding, error) {
+	b, err := newConfBinding("dyn", proto)
+	if err != nil {
+		return nil, err
+	}
+	if c.dyn != nil {
+		if err := (&confBindings{bindings: []*ConfBinding{b}}).update(c.dyn.Data()); err != nil {
+			return nil, err
+		}
+	}
+	c.dynBindings.add(b)
+	return b, nil
+}
+
+// binds local json to struct of the same type as proto, see Get
+func (c *ModernConf) BindLocal(proto interface{}) (*ConfBinding, error) {
+	b, err := newConfBinding("local", proto)
+	if err != nil {
+		return nil, err
+	}
+	if local := c.Local(); local != nil {
+		if err := (&confBindings{bindings: []*ConfBinding{b}}).update(local); err != nil {
+			return nil, err
+		}
+	}
+	c.localBindings.add(b)
+	return b, nil
+}
+
+// checks loaded dyn json and updates bound structs, error rejects the update.
+// secret references of dyn are not resolved, templates only with ExpandDynTemplates,
+// see template.go and secrets.go
+func (c *ModernConf) transformDyn(j js.IObject) (js.IObject, error) {
+	if c.ExpandDynTemplates && c.Templates != nil {
+		var err error
+		if j, err = c.Templates.ExpandJSON(j); err != nil {
+			return nil, err
+		}
+	}
+	registerJSONSecrets(j)
+	if err := c.dynSchema.Validate(j); err != nil {
+		return nil, err
+	}
+	if err := c.dynBindings.update(j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// prepares loaded local json and updates bound structs, error rejects the update
+func (c *ModernConf) transformLocal(j js.IObject) (js.IObject, error) {
+	j, err := c.prepareJSON(j)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.localSchema.Validate(j); err != nil {
+		return nil, err
+	}
+	if err := c.localBindings.update(j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (c *ModernConf) localUpdated(oldj, newj js.IReadonlyObject) {
+	if c.LocalUpdateHandler != nil {
+		c.LocalUpdateHandler(c, oldj)
+	}
+}
@@ -0,0 +1,237 @@
+package modern
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	js "github.com/rshmelev/go-json-light"
+)
+
+/*
+	what exactly has changed in dyn:
+
+	conf.DynDiffHandler = func(conf *ModernConf, diff *ConfDiff) { log(diff) }
+
+	conf.SubscribeDyn("limits.maxConn", 0, func(old, new interface{}) {
+		pool.Resize(new.(int))
+	})
+
+	subscription handler is called only when value at path has changed,
+	old and new have the type of proto (or are raw json values if proto is nil,
+	numbers are json.Number), and are nil if path doesn't exist.
+	paths look like limits.maxConn or hosts[0].name
+*/
+
+type ConfChange struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+type ConfDiff struct {
+	Added   []*ConfChange `json:"added,omitempty"`
+	Removed []*ConfChange `json:"removed,omitempty"`
+	Changed []*ConfChange `json:"changed,omitempty"`
+}
+
+type DynDiffHandler func(conf *ModernConf, diff *ConfDiff)
+type ConfPathChangeHandler func(old, new interface{})
+
+func (d *ConfDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func (d *ConfDiff) String() string {
+	s := []string{}
+	for _, c := range d.Added {
+		s = append(s, "+"+c.Path)
+	}
+	for _, c := range d.Removed {
+		s = append(s, "-"+c.Path)
+	}
+	for _, c := range d.Changed {
+		s = append(s, "~"+c.Path)
+	}
+	return strings.Join(s, " ")
+}
+
+// diff of leaf values, arrays are compared as a whole
+func DiffJSON(oldj, newj js.IReadonlyObject) *ConfDiff {
+	oldf, newf := flatJSON(oldj), flatJSON(newj)
+	d := &ConfDiff{}
+	for _, k := range sortedKeys(newf) {
+		ov, ok := oldf[k]
+		if !ok {
+			d.Added = append(d.Added, &ConfChange{Path: k, New: newf[k]})
+		} else if !reflect.DeepEqual(ov, newf[k]) {
+			d.Changed = append(d.Changed, &ConfChange{Path: k, Old: ov, New: newf[k]})
+		}
+	}
+	for _, k := range sortedKeys(oldf) {
+		if _, ok := newf[k]; !ok {
+			d.Removed = append(d.Removed, &ConfChange{Path: k, Old: oldf[k]})
+		}
+	}
+	return d
+}
+
+func flatJSON(o js.IReadonlyObject) map[string]interface{} {
+	flat := map[string]interface{}{}
+	if v := decodeJSON(o); v != nil {
+		flattenJSON("", v, flat)
+	}
+	return flat
+}
+
+// numbers are json.Number, see decodeJSONBytes
+func decodeJSON(o js.IReadonlyObject) interface{} {
+	if o == nil {
+		return nil
+	}
+	v, err := decodeJSONBytes(o.ToByteArray(0))
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// value at path like a.b[0].c in decoded json
+func jsonPathValue(v interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return v, true
+	}
+	for _, part := range strings.Split(path, ".") {
+		name, indexes := part, []int{}
+		if i := strings.Index(part, "["); i >= 0 {
+			name = part[:i]
+			for _, idx := range strings.Split(strings.TrimSuffix(part[i+1:], "]"), "][") {
+				n, err := strconv.Atoi(idx)
+				if err != nil {
+					return nil, false
+				}
+				indexes = append(indexes, n)
+			}
+		}
+		if name != "" {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if v, ok = m[name]; !ok {
+				return nil, false
+			}
+		}
+		for _, n := range indexes {
+			a, ok := v.([]interface{})
+			if !ok || n < 0 || n >= len(a) {
+				return nil, false
+			}
+			v = a[n]
+		}
+	}
+	return v, true
+}
+
+//=======================================================================
+
+type confSubscription struct {
+	path    string
+	typ     reflect.Type
+	handler ConfPathChangeHandler
+}
+
+// raw json value converted to subscription type
+func (s *confSubscription) convert(v interface{}, ok bool) (interface{}, error) {
+	if !ok {
+		return nil, nil
+	}
+	if s.typ == nil {
+		return v, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	res := reflect.New(s.typ)
+	if err := json.Unmarshal(b, res.Interface()); err != nil {
+		return nil, err
+	}
+	return res.Elem().Interface(), nil
+}
+
+type confSubscriptions struct {
+	mutex sync.Mutex
+	list  []*confSubscription
+}
+
+func (s *confSubscriptions) add(sub *confSubscription) {
+	s.mutex.Lock()
+	s.list = append(s.list, sub)
+	s.mutex.Unlock()
+}
+
+func (s *confSubscriptions) all() []*confSubscription {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*confSubscription{}, s.list...)
+}
+
+// calls handlers of subscriptions whose values differ in oldv and newv
+func (s *confSubscriptions) notify(oldv, newv interface{}, errorLog SimpleLogFunc) {
+	for _, sub := range s.all() {
+		ov, oldok := jsonPathValue(oldv, sub.path)
+		nv, newok := jsonPathValue(newv, sub.path)
+		if oldok == newok && reflect.DeepEqual(ov, nv) {
+			continue
+		}
+		o, err := sub.convert(ov, oldok)
+		if err == nil {
+			nv, err = sub.convert(nv, newok)
+		}
+		if err != nil {
+			errorLog("cannot convert dyn value at "+sub.path+": ", err)
+			continue
+		}
+		sub.handler(o, nv)
+	}
+}
+
+// handler is called when value at path changes in dyn, see confdiff.go
+func (c *ModernConf) SubscribeDyn(path string, proto interface{}, handler ConfPathChangeHandler) error {
+	if handler == nil {
+		return errors.New("handler is nil")
+	}
+	sub := &confSubscription{path: path, handler: handler}
+	if proto != nil {
+		sub.typ = reflect.TypeOf(proto)
+	}
+	c.dynSubscriptions.add(sub)
+	return nil
+}
+
+// called on every accepted dyn update
+func (c *ModernConf) dynUpdated(oldj, newj js.IReadonlyObject) {
+	if c.DynUpdateHandler != nil {
+		c.DynUpdateHandler(c, oldj)
+	}
+	if c.DynDiffHandler != nil {
+		if diff := DiffJSON(oldj, newj); !diff.Empty() {
+			c.DynDiffHandler(c, diff)
+		}
+	}
+	c.dynSubscriptions.notify(decodeJSON(oldj), decodeJSON(newj), c.ErrorLog)
+}
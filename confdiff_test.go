@@ -0,0 +1,130 @@
+package modern
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	js "github.com/rshmelev/go-json-light"
+)
+
+func diffTestObject(t *testing.T, s string) js.IReadonlyObject {
+	t.Helper()
+	o, err := js.NewObjectFromBytes([]byte(s))
+	if err != nil {
+		t.Fatalf("bad test json %s: %v", s, err)
+	}
+	return o.ToReadonlyObject()
+}
+
+func diffTestValue(t *testing.T, s string) interface{} {
+	t.Helper()
+	v, err := decodeJSONBytes([]byte(s))
+	if err != nil {
+		t.Fatalf("bad test json %s: %v", s, err)
+	}
+	return v
+}
+
+func TestDiffJSON(t *testing.T) {
+	cases := []struct {
+		name     string
+		old, new string
+		diff     string
+	}{
+		{"same", `{"a":1,"b":{"c":"x"}}`, `{"b":{"c":"x"},"a":1}`, ""},
+		{"added", `{"a":1}`, `{"a":1,"b":{"c":2}}`, "+b.c"},
+		{"removed", `{"a":1,"b":2}`, `{"a":1}`, "-b"},
+		{"changed", `{"a":{"b":1}}`, `{"a":{"b":2}}`, "~a.b"},
+		{"array as a whole", `{"a":[1,2]}`, `{"a":[1,3]}`, "~a"},
+		{"empty object is a leaf", `{"a":{}}`, `{"a":{"b":1}}`, "+a.b -a"},
+		{"sorted paths", `{"z":1,"a":1}`, `{"y":1,"b":1}`, "+b +y -a -z"},
+		{"big numbers keep precision", `{"id":9007199254740993}`, `{"id":9007199254740992}`, "~id"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := DiffJSON(diffTestObject(t, tc.old), diffTestObject(t, tc.new))
+			if s := d.String(); s != tc.diff {
+				t.Fatalf("expected diff %q, got %q", tc.diff, s)
+			}
+			if d.Empty() != (tc.diff == "") {
+				t.Fatalf("Empty() is %v for diff %q", d.Empty(), tc.diff)
+			}
+		})
+	}
+	if d := DiffJSON(nil, diffTestObject(t, `{"a":1}`)); d.String() != "+a" {
+		t.Fatalf("everything is added to nil, got %q", d.String())
+	}
+}
+
+func TestDiffJSONNumbers(t *testing.T) {
+	d := DiffJSON(diffTestObject(t, `{"id":9007199254740993}`), diffTestObject(t, `{"id":9007199254740995}`))
+	if len(d.Changed) != 1 {
+		t.Fatalf("expected one change, got %v", d)
+	}
+	if c := d.Changed[0]; c.Old != json.Number("9007199254740993") || c.New != json.Number("9007199254740995") {
+		t.Fatalf("numbers lost precision: %v -> %v", c.Old, c.New)
+	}
+}
+
+func TestJSONPathValue(t *testing.T) {
+	v := diffTestValue(t, `{"a":{"b":[{"c":"x"},[1,2]],"n":12345678901234567890},"e":null}`)
+	cases := []struct {
+		path  string
+		value interface{}
+		ok    bool
+	}{
+		{"a.b[0].c", "x", true},
+		{"a.b[1][1]", json.Number("2"), true},
+		{"a.n", json.Number("12345678901234567890"), true},
+		{"e", nil, true},
+		{"a.b[2]", nil, false},
+		{"a.b[-1]", nil, false},
+		{"a.b[x]", nil, false},
+		{"a.missing", nil, false},
+		{"a.b.c", nil, false},
+		{"a.n[0]", nil, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			res, ok := jsonPathValue(v, tc.path)
+			if ok != tc.ok || !reflect.DeepEqual(res, tc.value) {
+				t.Fatalf("expected %v %v, got %v %v", tc.value, tc.ok, res, ok)
+			}
+		})
+	}
+	if res, ok := jsonPathValue(v, ""); !ok || !reflect.DeepEqual(res, v) {
+		t.Fatalf("empty path should return the value itself")
+	}
+}
+
+func TestConfSubscriptionsNotify(t *testing.T) {
+	oldv := diffTestValue(t, `{"limits":{"max":1,"min":0},"name":"a"}`)
+	newv := diffTestValue(t, `{"limits":{"max":2,"min":0}}`)
+
+	calls := map[string][]interface{}{}
+	s := &confSubscriptions{}
+	for _, sub := range []struct {
+		path  string
+		proto interface{}
+	}{{"limits.max", 0}, {"limits.min", 0}, {"name", ""}, {"limits", nil}} {
+		path := sub.path
+		cs := &confSubscription{path: path, handler: func(old, new interface{}) {
+			calls[path] = []interface{}{old, new}
+		}}
+		if sub.proto != nil {
+			cs.typ = reflect.TypeOf(sub.proto)
+		}
+		s.add(cs)
+	}
+	s.notify(oldv, newv, func(params ...interface{}) { t.Fatal(params...) })
+
+	expected := map[string][]interface{}{
+		"limits.max": {1, 2},
+		"name":       {"a", nil},
+		"limits":     {diffTestValue(t, `{"max":1,"min":0}`), diffTestValue(t, `{"max":2,"min":0}`)},
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, calls)
+	}
+}
@@ -0,0 +1,129 @@
+package modern
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+/*
+	walks exported fields of configuration structs the same way envconfig does,
+	so we know env var name of every field
+*/
+
+type confField struct {
+	Path   string // Db.Host
+	EnvKey string // MYAPP_DB_HOST
+	Field  reflect.StructField
+	Value  reflect.Value
+}
+
+func (f *confField) String() string {
+	if !f.Value.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(f.Value.Interface())
+}
+
+var secretFieldRx = regexp.MustCompile(`(?i)(password|passwd|secret|token|apikey|api_key|privatekey|private_key|credential)`)
+
+// field is secret if it has `secret:"true"` tag or its name looks like a secret
+func (f *confField) IsSecret() bool {
+	if tag, ok := f.Field.Tag.Lookup("secret"); ok {
+		return tag == "true"
+	}
+	return secretFieldRx.MatchString(f.Field.Name)
+}
+
+// calls fn for every leaf field of struct that s points to
+func walkConfFields(appname string, s interface{}, fn func(f *confField)) {
+	if s == nil {
+		return
+	}
+	v := reflect.ValueOf(s)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	prefix := ""
+	if appname != "" {
+		prefix = strings.ToUpper(appname) + "_"
+	}
+	walkConfStruct("", prefix, v, fn)
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+func walkConfStruct(pathPrefix, envPrefix string, v reflect.Value, fn func(f *confField)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" || sf.Tag.Get("ignored") == "true" {
+			continue // unexported
+		}
+		fv := v.Field(i)
+
+		key := sf.Name
+		if tag := sf.Tag.Get("envconfig"); tag != "" {
+			key = tag
+		} else if sf.Tag.Get("split_words") == "true" {
+			key = splitWords(sf.Name)
+		}
+		key = strings.ToUpper(key)
+
+		isStruct := sf.Type.Kind() == reflect.Struct ||
+			(sf.Type.Kind() == reflect.Ptr && sf.Type.Elem().Kind() == reflect.Struct)
+		if isStruct && !reflect.PtrTo(sf.Type).Implements(textUnmarshalerType) && !sf.Type.Implements(textUnmarshalerType) {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			nestedPrefix := envPrefix + key + "_"
+			if sf.Anonymous {
+				nestedPrefix = envPrefix
+			}
+			walkConfStruct(pathPrefix+sf.Name+".", nestedPrefix, fv, fn)
+			continue
+		}
+
+		fn(&confField{
+			Path:   pathPrefix + sf.Name,
+			EnvKey: envPrefix + key,
+			Field:  sf,
+			Value:  fv,
+		})
+	}
+}
+
+// HttpBindAddr -> HTTP_BIND_ADDR, like envconfig split_words does
+func splitWords(s string) string {
+	res := []rune{}
+	runes := []rune(s)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) &&
+			(unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			res = append(res, '_')
+		}
+		res = append(res, r)
+	}
+	return string(res)
+}
+
+// path -> string value of every field
+func snapshotConfFields(appname string, s interface{}) map[string]string {
+	m := map[string]string{}
+	walkConfFields(appname, s, func(f *confField) {
+		m[f.Path] = f.String()
+	})
+	return m
+}
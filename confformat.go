@@ -0,0 +1,183 @@
+package modern
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	js "github.com/rshmelev/go-json-light"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+	local, dyn and state may be json, yaml or toml.
+	format is taken from the extension (.yaml, .yml, .toml), then from Content-Type,
+	json is the default. yaml comments, anchors and aliases are fine.
+	everything is converted to the same js.IObject, state is saved back in its own format
+*/
+
+const (
+	ConfFormatJSON = "json"
+	ConfFormatYAML = "yaml"
+	ConfFormatTOML = "toml"
+)
+
+func DetectConfFormat(url, contentType string) string {
+	p := url
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+	switch strings.ToLower(path.Ext(p)) {
+	case ".yaml", ".yml":
+		return ConfFormatYAML
+	case ".toml":
+		return ConfFormatTOML
+	case ".json":
+		return ConfFormatJSON
+	}
+	ct := strings.ToLower(contentType)
+	switch {
+	case strings.Contains(ct, "yaml"):
+		return ConfFormatYAML
+	case strings.Contains(ct, "toml"):
+		return ConfFormatTOML
+	}
+	return ConfFormatJSON
+}
+
+// converts yaml or toml to json, json is returned as is
+func ConfToJSON(format string, b []byte) ([]byte, error) {
+	var v interface{}
+	switch format {
+	case ConfFormatJSON, "":
+		return b, nil
+	case ConfFormatYAML:
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+		if v == nil {
+			v = map[string]interface{}{} // empty document
+		}
+	case ConfFormatTOML:
+		m := map[string]interface{}{}
+		if err := toml.Unmarshal(b, &m); err != nil {
+			return nil, err
+		}
+		v = m
+	default:
+		return nil, errors.New("unknown conf format: " + format)
+	}
+	v, err := jsonCompatible(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// converts json to yaml or toml, json is returned as is
+func JSONToConf(format string, b []byte) ([]byte, error) {
+	if format == ConfFormatJSON || format == "" {
+		return b, nil
+	}
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	v = typedNumbers(v)
+	switch format {
+	case ConfFormatYAML:
+		return yaml.Marshal(v)
+	case ConfFormatTOML:
+		buf := &bytes.Buffer{}
+		if err := toml.NewEncoder(buf).Encode(v); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, errors.New("unknown conf format: " + format)
+}
+
+// json.Number -> int64 or float64, so 1 doesn't become 1.0 in toml
+func typedNumbers(v interface{}) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	case map[string]interface{}:
+		for k, vv := range x {
+			x[k] = typedNumbers(vv)
+		}
+	case []interface{}:
+		for i, vv := range x {
+			x[i] = typedNumbers(vv)
+		}
+	}
+	return v
+}
+
+// yaml may have non-string keys, json may not
+func jsonCompatible(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range x {
+			res, err := jsonCompatible(vv)
+			if err != nil {
+				return nil, err
+			}
+			x[k] = res
+		}
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, vv := range x {
+			res, err := jsonCompatible(vv)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(k)] = res
+		}
+		return m, nil
+	case []interface{}:
+		for i, vv := range x {
+			res, err := jsonCompatible(vv)
+			if err != nil {
+				return nil, err
+			}
+			x[i] = res
+		}
+	case []map[string]interface{}: // toml array of tables
+		res := make([]interface{}, len(x))
+		for i, vv := range x {
+			res[i] = vv
+		}
+		return jsonCompatible(res)
+	}
+	return v, nil
+}
+
+// loads json, yaml or toml file (or url), returns object and detected format
+func LoadConfObject(url string, timeout time.Duration) (js.IObject, string, error) {
+	r := F.GetByteContents(url, timeout)
+	if r.Err != nil {
+		return nil, "", r.Err
+	}
+	if r.Code != 200 {
+		return nil, "", errors.New(fmt.Sprint("got sad HTTP code ", r.Code, " while loading ", url))
+	}
+	format := DetectConfFormat(url, r.ContentType)
+	b, err := ConfToJSON(format, r.Body)
+	if err != nil {
+		return nil, format, errors.New("cannot parse " + format + " " + url + ": " + err.Error())
+	}
+	o, err := js.NewObjectFromBytes(b)
+	return o, format, err
+}
@@ -0,0 +1,104 @@
+package modern
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func confFormatValue(t *testing.T, b []byte) interface{} {
+	t.Helper()
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		t.Fatalf("bad json %s: %v", b, err)
+	}
+	return v
+}
+
+func TestDetectConfFormat(t *testing.T) {
+	cases := []struct {
+		url, contentType, format string
+	}{
+		{"conf/local.json", "", ConfFormatJSON},
+		{"conf/local.yaml", "", ConfFormatYAML},
+		{"conf/local.YML", "", ConfFormatYAML},
+		{"conf/local.toml", "", ConfFormatTOML},
+		{"conf/local", "", ConfFormatJSON},
+		{"http://host/dyn.yaml?v=1#top", "", ConfFormatYAML},
+		{"http://host/dyn", "application/x-yaml", ConfFormatYAML},
+		{"http://host/dyn", "text/yaml; charset=utf-8", ConfFormatYAML},
+		{"http://host/dyn", "application/toml", ConfFormatTOML},
+		{"http://host/dyn", "application/json", ConfFormatJSON},
+		{"http://host/dyn.toml", "application/x-yaml", ConfFormatTOML},
+		{"http://host/dyn.json", "text/yaml", ConfFormatJSON},
+	}
+	for _, tc := range cases {
+		if f := DetectConfFormat(tc.url, tc.contentType); f != tc.format {
+			t.Errorf("DetectConfFormat(%q, %q) = %q, expected %q", tc.url, tc.contentType, f, tc.format)
+		}
+	}
+}
+
+func TestConfToJSON(t *testing.T) {
+	cases := []struct {
+		name, format, in, out string
+		err                   string
+	}{
+		{"json as is", ConfFormatJSON, `{"a":1}`, `{"a":1}`, ""},
+		{"yaml", ConfFormatYAML, "a: 1\nb: [x, y]\n# comment\nc: {d: true}\n", `{"a":1,"b":["x","y"],"c":{"d":true}}`, ""},
+		{"yaml non-string keys", ConfFormatYAML, "codes:\n  200: ok\n  404: missing\nflags:\n  true: on\n", `{"codes":{"200":"ok","404":"missing"},"flags":{"true":"on"}}`, ""},
+		{"yaml anchors", ConfFormatYAML, "base: &b\n  host: h\n  port: 1\nprod:\n  <<: *b\n  port: 2\nsame: *b\n", `{"base":{"host":"h","port":1},"prod":{"host":"h","port":2},"same":{"host":"h","port":1}}`, ""},
+		{"empty yaml", ConfFormatYAML, "", `{}`, ""},
+		{"bad yaml", ConfFormatYAML, "a: [1\n", "", "yaml"},
+		{"toml", ConfFormatTOML, "a = 1\n[b]\nc = \"x\"\n", `{"a":1,"b":{"c":"x"}}`, ""},
+		{"toml array of tables", ConfFormatTOML, "[[servers]]\nname = \"a\"\n[[servers]]\nname = \"b\"\nports = [1, 2]\n", `{"servers":[{"name":"a"},{"name":"b","ports":[1,2]}]}`, ""},
+		{"bad toml", ConfFormatTOML, "a = \n", "", "toml"},
+		{"unknown format", "ini", "a=1", "", "unknown conf format: ini"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := ConfToJSON(tc.format, []byte(tc.in))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error with %q, got %s, %v", tc.err, res, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(confFormatValue(t, res), confFormatValue(t, []byte(tc.out))) {
+				t.Fatalf("expected %s, got %s", tc.out, res)
+			}
+		})
+	}
+}
+
+func TestJSONToConfRoundTrip(t *testing.T) {
+	state := []byte(`{"count":1,"ratio":0.5,"name":"x","list":[1,"two"],"nested":{"big":9007199254740993,"ok":true}}`)
+	for _, format := range []string{ConfFormatJSON, ConfFormatYAML, ConfFormatTOML} {
+		t.Run(format, func(t *testing.T) {
+			conf, err := JSONToConf(format, state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format == ConfFormatTOML && !bytes.Contains(conf, []byte("count = 1\n")) {
+				t.Fatalf("integers should stay integers in toml:\n%s", conf)
+			}
+			res, err := ConfToJSON(format, conf)
+			if err != nil {
+				t.Fatalf("cannot parse saved %s: %v\n%s", format, err, conf)
+			}
+			if !reflect.DeepEqual(confFormatValue(t, res), confFormatValue(t, state)) {
+				t.Fatalf("expected %s, got %s", state, res)
+			}
+		})
+	}
+	if _, err := JSONToConf("ini", state); err == nil {
+		t.Fatal("unknown format should fail")
+	}
+}
@@ -0,0 +1,217 @@
+package modern
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+
+	js "github.com/rshmelev/go-json-light"
+)
+
+/*
+	effective configuration with the source of every value:
+	TrivialSetupConf and envconf fields, local.json and dyn.json keys.
+	secrets are masked.
+
+	available as __printconfig command and as TrivialSetupConf.ConfigDumpURL endpoint,
+	the endpoint requires AdminToken the same way as admin api does
+*/
+
+type ConfigValue struct {
+	Section string `json:"section"` // setup, env, local, dyn
+	Path    string `json:"path"`
+	EnvKey  string `json:"envkey,omitempty"`
+	Value   string `json:"value"`
+	Source  string `json:"source"`
+	Secret  bool   `json:"secret,omitempty"`
+}
+
+type ConfigReport []*ConfigValue
+
+const maskedValue = "******"
+
+func (r ConfigReport) String() string {
+	width := 0
+	for _, v := range r {
+		if l := len(v.Section) + len(v.Path) + 1; l > width {
+			width = l
+		}
+	}
+	s := ""
+	for _, v := range r {
+		name := v.Section + ":" + v.Path
+		s += name + strings.Repeat(" ", width-len(name)) + " = " + v.Value + "    [" + v.Source + "]\n"
+	}
+	return s
+}
+
+// one stage of configuration loading (init tag, env, ...)
+type confStage struct {
+	name   string
+	values map[string]string
+}
+
+// remembers values of struct fields after every loading stage
+type confTracker struct {
+	appname string
+	target  interface{}
+	stages  []*confStage
+}
+
+func newConfTracker(appname string, target interface{}) *confTracker {
+	t := &confTracker{appname: appname, target: target}
+	t.Stage("code")
+	return t
+}
+
+func (t *confTracker) Stage(name string) {
+	t.stages = append(t.stages, &confStage{name: name, values: snapshotConfFields(t.appname, t.target)})
+}
+
+// the last stage that changed the field
+func (t *confTracker) sourceOf(path string) string {
+	source := ""
+	prev := ""
+	for i, st := range t.stages {
+		v := st.values[path]
+		if (i == 0 && v != "") || (i > 0 && v != prev) {
+			source = st.name
+		}
+		prev = v
+	}
+	if source == "" {
+		return "empty"
+	}
+	return source
+}
+
+func (t *confTracker) report(section string, envOrigins map[string]string) ConfigReport {
+	res := ConfigReport{}
+	if t == nil {
+		return res
+	}
+	walkConfFields(t.appname, t.target, func(f *confField) {
+		v := &ConfigValue{
+			Section: section,
+			Path:    f.Path,
+			EnvKey:  f.EnvKey,
+			Value:   f.String(),
+			Source:  t.sourceOf(f.Path),
+			Secret:  f.IsSecret(),
+		}
+		if v.Source == "env" {
+			if _, ok := os.LookupEnv(f.EnvKey); !ok {
+				v.Source = "default tag" // envconfig `default:"..."`
+			} else {
+				v.Source = "env " + f.EnvKey
+			}
+			if origin, ok := envOrigins[f.EnvKey]; ok && v.Source != "default tag" {
+				v.Source += " from " + origin
+			}
+		}
+		if r := RedactSecrets(v.Value); r != v.Value {
+			v.Secret = true
+		}
+		if v.Secret && v.Value != "" {
+			v.Value = maskedValue
+		}
+		res = append(res, v)
+	})
+	return res
+}
+
+// flat list of json values, keys that look like secrets are masked
+func jsonConfigReport(section, source string, o js.IReadonlyObject) ConfigReport {
+	res := ConfigReport{}
+	if o == nil {
+		return res
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(o.ToByteArray(0), &m); err != nil {
+		return res
+	}
+	flat := map[string]interface{}{}
+	flattenJSON("", m, flat)
+	keys := make([]string, 0, len(flat))
+	for k := range flat {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b, _ := json.Marshal(flat[k])
+		v := &ConfigValue{
+			Section: section,
+			Path:    k,
+			Value:   string(b),
+			Source:  source,
+			Secret:  secretFieldRx.MatchString(k),
+		}
+		v.Value = RedactSecrets(v.Value)
+		if v.Secret {
+			v.Value = maskedValue
+		}
+		res = append(res, v)
+	}
+	return res
+}
+
+// {"a": {"b": 1}} -> {"a.b": 1}
+func flattenJSON(prefix string, v interface{}, res map[string]interface{}) {
+	m, ok := v.(map[string]interface{})
+	if !ok || (len(m) == 0 && prefix != "") {
+		res[prefix] = v
+		return
+	}
+	for k, vv := range m {
+		p := k
+		if prefix != "" {
+			p = prefix + "." + k
+		}
+		flattenJSON(p, vv, res)
+	}
+}
+
+//=======================================================================
+
+// effective configuration of the app
+func (a *App) ConfigReport() ConfigReport {
+	res := a.setupConfTracker.report("setup", a.envOrigins)
+	res = append(res, a.envConfTracker.report("env", a.envOrigins)...)
+
+	mc := a.ModernConf
+	if mc == nil {
+		return res
+	}
+	local := mc.Local()
+	dyn := mc.dyn
+	if local == nil && good(mc.LocalConfFile) {
+		// not started yet (e.g. __printconfig), load it once
+		if o, _, err := LoadConfObject(mc.LocalConfFile, mc.ConfLoadTimeout); err == nil {
+			local = o
+		}
+	}
+	if local != nil {
+		res = append(res, jsonConfigReport("local", mc.LocalConfFile, local)...)
+	}
+	if dyn != nil {
+		res = append(res, jsonConfigReport("dyn", mc.DynConfUrl, dyn.Data())...)
+	} else if good(mc.DynConfUrl) {
+		if o, _, err := LoadConfObject(mc.DynConfUrl, mc.ConfLoadTimeout); err == nil {
+			res = append(res, jsonConfigReport("dyn", mc.DynConfUrl, o)...)
+		}
+	}
+	return res
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:       "__printconfig",
+		Help:       "print effective configuration with the source of every value",
+		AfterSetup: true,
+		Run: func(app *App, args []string) int {
+			print(app.ConfigReport().String())
+			return ExitOk
+		},
+	})
+}
@@ -0,0 +1,207 @@
+package modern
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	js "github.com/rshmelev/go-json-light"
+)
+
+/*
+	one merged view of configuration, later layers win:
+
+	defaults < local < dyn < env
+
+	defaults are ModernConf.Defaults, env overrides look like
+	MYAPP_CONF__limits__max=100   ->   {"limits": {"max": 100}}
+	(value is json if it parses as json, string otherwise, secret references are resolved).
+
+	objects are merged deeply, everything else (arrays too) is replaced.
+
+	v, layer, ok := conf.Get("limits.max")   // json.Number("100"), "env", true
+*/
+
+const (
+	LayerDefaults = "defaults"
+	LayerLocal    = "local"
+	LayerDyn      = "dyn"
+	LayerEnv      = "env"
+)
+
+// between app prefix and path of env override
+const confEnvOverrideInfix = "CONF__"
+
+type confLayer struct {
+	name  string
+	value interface{}
+}
+
+type confOverlay struct {
+	layers []*confLayer // in order of precedence, the last wins
+	merged interface{}
+
+	dynVersion   int
+	localVersion int
+}
+
+// MYAPP_CONF__a__b=1 -> {"a": {"b": 1}}
+func envOverrides(appname string) (map[string]interface{}, error) {
+	prefix := strings.ToUpper(appname) + "_" + confEnvOverrideInfix
+	res := map[string]interface{}{}
+	keys := []string{}
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 && strings.HasPrefix(parts[0], prefix) && len(parts[0]) > len(prefix) {
+			keys = append(keys, parts[0])
+			env[parts[0]] = parts[1]
+		}
+	}
+	sort.Strings(keys) // a__b is applied before a__b__c
+	for _, key := range keys {
+		path := strings.Split(key[len(prefix):], "__")
+		v, err := decodeJSONBytes([]byte(env[key]))
+		if err != nil {
+			s, err := ResolveSecretRef(env[key])
+			if err != nil {
+				return nil, errors.New("cannot resolve secret for " + key + ": " + err.Error())
+			}
+			if s != env[key] {
+				RegisterSecret(s)
+			}
+			v = s
+		}
+		m := res
+		for _, p := range path[:len(path)-1] {
+			next, ok := m[p].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				m[p] = next
+			}
+			m = next
+		}
+		m[path[len(path)-1]] = v
+	}
+	return res, nil
+}
+
+// deep copy of a with b merged into it
+func mergeJSON(a, b interface{}) interface{} {
+	bm, ok := b.(map[string]interface{})
+	if !ok {
+		return copyJSON(b)
+	}
+	am, ok := a.(map[string]interface{})
+	if !ok {
+		return copyJSON(b)
+	}
+	res := copyJSON(am).(map[string]interface{})
+	for k, v := range bm {
+		if old, ok := res[k]; ok {
+			res[k] = mergeJSON(old, v)
+		} else {
+			res[k] = copyJSON(v)
+		}
+	}
+	return res
+}
+
+func copyJSON(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, vv := range x {
+			m[k] = copyJSON(vv)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(x))
+		for i, vv := range x {
+			a[i] = copyJSON(vv)
+		}
+		return a
+	}
+	return v
+}
+
+//=======================================================================
+
+type confOverlayCache struct {
+	mutex   sync.Mutex
+	overlay *confOverlay
+	env     map[string]interface{}
+}
+
+// current overlay, rebuilt only if local or dyn have changed
+func (c *ModernConf) currentOverlay() *confOverlay {
+	var local, dyn js.IReadonlyObject
+	localVersion, dynVersion := 0, 0
+	if c.localWatch != nil {
+		local, localVersion = c.localWatch.snapshot()
+	} else {
+		local = c.Local()
+	}
+	if c.dyn != nil {
+		dyn, dynVersion = c.dyn.snapshot()
+	}
+
+	oc := &c.overlayCache
+	oc.mutex.Lock()
+	defer oc.mutex.Unlock()
+	if o := oc.overlay; o != nil && o.localVersion == localVersion && o.dynVersion == dynVersion {
+		return o
+	}
+
+	var defaults interface{} = map[string]interface{}{}
+	if c.Defaults != nil {
+		defaults = copyJSON(c.Defaults)
+	}
+	o := &confOverlay{
+		layers: []*confLayer{
+			{LayerDefaults, defaults},
+			{LayerLocal, decodeJSON(local)},
+			{LayerDyn, decodeJSON(dyn)},
+			{LayerEnv, oc.env},
+		},
+		localVersion: localVersion,
+		dynVersion:   dynVersion,
+	}
+	for _, l := range o.layers {
+		if l.value != nil {
+			o.merged = mergeJSON(o.merged, l.value)
+		}
+	}
+	oc.overlay = o
+	return o
+}
+
+// defaults, local, dyn and env overrides merged together, see confoverlay.go
+func (c *ModernConf) Merged() js.IReadonlyObject {
+	b, _ := json.Marshal(c.currentOverlay().merged)
+	o, err := js.NewObjectFromBytes(b)
+	if err != nil {
+		return js.NewEmptyObject().ToReadonlyObject()
+	}
+	return o.ToReadonlyObject()
+}
+
+// value at path (like limits.max or hosts[0]) of merged configuration
+// and the layer that supplied it (the last layer that has this path), numbers are json.Number
+func (c *ModernConf) Get(path string) (interface{}, string, bool) {
+	o := c.currentOverlay()
+	v, ok := jsonPathValue(o.merged, path)
+	if !ok {
+		return nil, "", false
+	}
+	layer := ""
+	for _, l := range o.layers {
+		if _, ok := jsonPathValue(l.value, path); ok && l.value != nil {
+			layer = l.name
+		}
+	}
+	return copyJSON(v), layer, true
+}
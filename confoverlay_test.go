@@ -0,0 +1,131 @@
+package modern
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	js "github.com/rshmelev/go-json-light"
+)
+
+func overlayTestValue(t *testing.T, s string) interface{} {
+	t.Helper()
+	v, err := decodeJSONBytes([]byte(s))
+	if err != nil {
+		t.Fatalf("bad test json %s: %v", s, err)
+	}
+	return v
+}
+
+func overlayTestObject(t *testing.T, s string) js.IObject {
+	t.Helper()
+	o, err := js.NewObjectFromBytes([]byte(s))
+	if err != nil {
+		t.Fatalf("bad test json %s: %v", s, err)
+	}
+	return o
+}
+
+func TestMergeJSON(t *testing.T) {
+	cases := []struct {
+		name      string
+		a, b, res string
+	}{
+		{"deep merge", `{"a":{"x":1,"y":2},"b":1}`, `{"a":{"y":3,"z":4}}`, `{"a":{"x":1,"y":3,"z":4},"b":1}`},
+		{"arrays are replaced", `{"a":[1,2,3]}`, `{"a":[4]}`, `{"a":[4]}`},
+		{"object replaces scalar", `{"a":1}`, `{"a":{"b":2}}`, `{"a":{"b":2}}`},
+		{"scalar replaces object", `{"a":{"b":2}}`, `{"a":"x"}`, `{"a":"x"}`},
+		{"null replaces value", `{"a":1}`, `{"a":null}`, `{"a":null}`},
+		{"big numbers keep precision", `{"id":1}`, `{"id":9007199254740993}`, `{"id":9007199254740993}`},
+		{"empty b", `{"a":1}`, `{}`, `{"a":1}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := overlayTestValue(t, tc.a), overlayTestValue(t, tc.b)
+			res := mergeJSON(a, b)
+			if expected := overlayTestValue(t, tc.res); !reflect.DeepEqual(res, expected) {
+				t.Fatalf("expected %v, got %v", expected, res)
+			}
+			if !reflect.DeepEqual(a, overlayTestValue(t, tc.a)) || !reflect.DeepEqual(b, overlayTestValue(t, tc.b)) {
+				t.Fatalf("arguments were modified")
+			}
+		})
+	}
+	if res := mergeJSON(nil, overlayTestValue(t, `{"a":1}`)); !reflect.DeepEqual(res, overlayTestValue(t, `{"a":1}`)) {
+		t.Fatalf("merge into nil should copy b, got %v", res)
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	for k, v := range map[string]string{
+		"MODERNTEST_CONF__limits__max": "100",
+		"MODERNTEST_CONF__limits__big": "9007199254740993",
+		"MODERNTEST_CONF__name":        "plain string",
+		"MODERNTEST_CONF__hosts":       `["a","b"]`,
+		"MODERNTEST_CONF__a":           `{"b":1}`,
+		"MODERNTEST_CONF__a__c":        "true",
+		"MODERNTEST_CONF__":            "ignored",
+		"MODERNTEST_OTHER":             "ignored",
+	} {
+		t.Setenv(k, v)
+	}
+
+	res, err := envOverrides("moderntest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"limits": map[string]interface{}{"max": json.Number("100"), "big": json.Number("9007199254740993")},
+		"name":   "plain string",
+		"hosts":  []interface{}{"a", "b"},
+		"a":      map[string]interface{}{"b": json.Number("1"), "c": true},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+}
+
+func TestConfGetPrecedence(t *testing.T) {
+	c := &ModernConf{
+		Defaults: map[string]interface{}{"a": 1, "b": 1, "c": 1, "d": 1, "nested": map[string]interface{}{"x": 1}},
+	}
+	c.local = overlayTestObject(t, `{"b":2,"c":2,"d":2,"nested":{"y":2}}`)
+	c.dyn = &AutoLoadJSON{json: overlayTestObject(t, `{"c":3,"d":3,"big":9007199254740993}`), version: 1}
+	c.overlayCache.env = map[string]interface{}{"d": json.Number("4")}
+
+	cases := []struct {
+		path  string
+		value interface{}
+		layer string
+		ok    bool
+	}{
+		{"a", 1, LayerDefaults, true},
+		{"b", json.Number("2"), LayerLocal, true},
+		{"c", json.Number("3"), LayerDyn, true},
+		{"d", json.Number("4"), LayerEnv, true},
+		{"big", json.Number("9007199254740993"), LayerDyn, true},
+		{"nested.x", 1, LayerDefaults, true},
+		{"nested.y", json.Number("2"), LayerLocal, true},
+		{"missing", nil, "", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			v, layer, ok := c.Get(tc.path)
+			if ok != tc.ok || layer != tc.layer || !reflect.DeepEqual(v, tc.value) {
+				t.Fatalf("expected %v %q %v, got %v %q %v", tc.value, tc.layer, tc.ok, v, layer, ok)
+			}
+		})
+	}
+
+	// overlay is rebuilt when dyn changes
+	c.dyn.mutex.Lock()
+	c.dyn.json = overlayTestObject(t, `{"c":30}`)
+	c.dyn.version++
+	c.dyn.mutex.Unlock()
+	if v, layer, _ := c.Get("c"); v != json.Number("30") || layer != LayerDyn {
+		t.Fatalf("overlay is not rebuilt after dyn update: %v %q", v, layer)
+	}
+	if v, layer, _ := c.Get("d"); v != json.Number("4") || layer != LayerEnv {
+		t.Fatalf("env override is lost: %v %q", v, layer)
+	}
+}
@@ -0,0 +1,168 @@
+package modern
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	dyn can be signed with ed25519, public keys are set in TrivialSetupConf.DynSigningKeys
+	(base64 or hex, MYAPP_DYNSIGNINGKEYS=key1,key2 for rotation). then every update has to be
+
+	- detached: body as is, and {"version": 42, "signature": "<base64>"} at DynConfUrl + ".sig"
+	- embedded: {"payload": "<base64 of the body>", "version": 42, "signature": "<base64>"}
+
+	signature covers version and body (see signedMessage). version has to grow with every
+	publication (unix time is fine): older version, or the same version with other body,
+	is rejected, so an old signed dyn can't be replayed. the accepted version is kept
+	in DynCacheFile (unless it is "-"), so it is known after restart too.
+
+	unsigned, badly signed or replayed update is rejected, the previous one stays active,
+	and the error is shown in the healthpoint
+*/
+
+type signedEnvelope struct {
+	Payload   string `json:"payload,omitempty"`
+	Version   int64  `json:"version"`
+	Signature string `json:"signature"`
+}
+
+type dynVerifier struct {
+	url     string
+	keys    []ed25519.PublicKey
+	timeout time.Duration
+
+	mutex    sync.Mutex
+	accepted bool
+	version  int64    // of the last accepted update
+	digest   [32]byte // of its payload
+}
+
+// nil if there are no keys, so nothing has to be verified
+func newDynVerifier(url string, keys []string, timeout time.Duration) (*dynVerifier, error) {
+	v := &dynVerifier{url: url, timeout: timeout}
+	for _, k := range keys {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		b, err := decodeSigningBytes(k)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, errors.New("bad dyn signing key: " + k)
+		}
+		v.keys = append(v.keys, ed25519.PublicKey(b))
+	}
+	if len(v.keys) == 0 {
+		return nil, nil
+	}
+	return v, nil
+}
+
+// base64 (std or url) or hex
+func decodeSigningBytes(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if b, err := hex.DecodeString(s); err == nil {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.URLEncoding.DecodeString(s)
+}
+
+// what is signed: version, newline, body
+func signedMessage(version int64, payload []byte) []byte {
+	return append([]byte(strconv.FormatInt(version, 10)+"\n"), payload...)
+}
+
+// returns signed payload and embedded envelope of it (that can be verified again, used for cache)
+func (v *dynVerifier) Verify(body []byte) ([]byte, []byte, error) {
+	var env signedEnvelope
+	payload := body
+	if err := json.Unmarshal(body, &env); err == nil && env.Payload != "" && env.Signature != "" {
+		var err error
+		if payload, err = base64.StdEncoding.DecodeString(env.Payload); err != nil {
+			return nil, nil, errors.New("bad payload of signed dyn: " + err.Error())
+		}
+	} else {
+		sigurl := v.url + ".sig"
+		if i := strings.Index(v.url, "?"); i >= 0 {
+			sigurl = v.url[:i] + ".sig" + v.url[i:]
+		}
+		r := F.GetByteContents(sigurl, v.timeout)
+		if r.Err != nil || r.Code != 200 {
+			return nil, nil, errors.New("dyn is not signed, cannot load " + sigurl + ": " + r.ToStringOrError())
+		}
+		env = signedEnvelope{}
+		if err := json.Unmarshal(r.Body, &env); err != nil || env.Signature == "" {
+			return nil, nil, errors.New("bad signature file " + sigurl + ", {\"version\": ..., \"signature\": ...} is expected")
+		}
+		env.Payload = base64.StdEncoding.EncodeToString(payload)
+	}
+	if err := v.check(signedMessage(env.Version, payload), env.Signature); err != nil {
+		return nil, nil, err
+	}
+	if err := v.accept(env.Version, payload); err != nil {
+		return nil, nil, err
+	}
+	signed, _ := json.Marshal(&env)
+	return payload, signed, nil
+}
+
+func (v *dynVerifier) check(message []byte, signature string) error {
+	sig, err := decodeSigningBytes(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return errors.New("bad dyn signature format")
+	}
+	for _, k := range v.keys {
+		if ed25519.Verify(k, message, sig) {
+			return nil
+		}
+	}
+	return fmt.Errorf("dyn signature doesn't match any of %d keys", len(v.keys))
+}
+
+// rejects versions older than accepted one
+func (v *dynVerifier) accept(version int64, payload []byte) error {
+	digest := sha256.Sum256(payload)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.accepted {
+		if version < v.version {
+			return fmt.Errorf("dyn version %d is older than accepted %d", version, v.version)
+		}
+		if version == v.version && digest != v.digest {
+			return fmt.Errorf("dyn version %d has been accepted with other content", version)
+		}
+	}
+	v.accepted, v.version, v.digest = true, version, digest
+	return nil
+}
+
+// content of DynConfUrl + ".sig" for detached signature
+func SignConfDetached(key ed25519.PrivateKey, version int64, body []byte) []byte {
+	b, _ := json.Marshal(&signedEnvelope{
+		Version:   version,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, signedMessage(version, body))),
+	})
+	return b
+}
+
+// body with embedded signature
+func SignConfEmbedded(key ed25519.PrivateKey, version int64, body []byte) []byte {
+	b, _ := json.Marshal(&signedEnvelope{
+		Payload:   base64.StdEncoding.EncodeToString(body),
+		Version:   version,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, signedMessage(version, body))),
+	})
+	return b
+}
@@ -0,0 +1,162 @@
+package modern
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecodeSigningBytes(t *testing.T) {
+	raw := []byte{0, 1, 2, 250, 251, 252, 253, 254, 255}
+	cases := []struct {
+		name, in string
+		ok       bool
+	}{
+		{"hex", hex.EncodeToString(raw), true},
+		{"hex with spaces", "  " + hex.EncodeToString(raw) + "\n", true},
+		{"base64", base64.StdEncoding.EncodeToString(raw), true},
+		{"base64 url", base64.URLEncoding.EncodeToString(raw), true},
+		{"garbage", "not a key!", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := decodeSigningBytes(tc.in)
+			if !tc.ok {
+				if err == nil {
+					t.Fatalf("expected error, got %v", b)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(b, raw) {
+				t.Fatalf("expected %v, got %v, %v", raw, b, err)
+			}
+		})
+	}
+}
+
+func TestNewDynVerifier(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	cases := []struct {
+		name  string
+		keys  []string
+		nkeys int
+		err   bool
+	}{
+		{"no keys", nil, 0, false},
+		{"empty keys", []string{"", " "}, 0, false},
+		{"base64 and hex", []string{base64.StdEncoding.EncodeToString(pub), hex.EncodeToString(pub)}, 2, false},
+		{"short key", []string{hex.EncodeToString(pub[:16])}, 0, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := newDynVerifier("dyn.json", tc.keys, 0)
+			if tc.err != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.nkeys == 0 && v != nil || tc.nkeys > 0 && (v == nil || len(v.keys) != tc.nkeys) {
+				t.Fatalf("expected %d keys, got %+v", tc.nkeys, v)
+			}
+		})
+	}
+}
+
+func TestDynVerifierEmbedded(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	body1, body2 := []byte(`{"a":1}`), []byte(`{"a":2}`)
+
+	v, err := newDynVerifier("dyn.json", []string{base64.StdEncoding.EncodeToString(pub)}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := SignConfEmbedded(key, 10, body1)
+	tampered = bytes.Replace(tampered, []byte(`"version":10`), []byte(`"version":11`), 1)
+
+	// applied one after another to the same verifier
+	cases := []struct {
+		name    string
+		body    []byte
+		payload []byte
+		err     string
+	}{
+		{"signed", SignConfEmbedded(key, 10, body1), body1, ""},
+		{"same again", SignConfEmbedded(key, 10, body1), body1, ""},
+		{"other key", SignConfEmbedded(otherKey, 20, body2), nil, "doesn't match any of 1 keys"},
+		{"version is signed too", tampered, nil, "doesn't match any of 1 keys"},
+		{"same version, other body", SignConfEmbedded(key, 10, body2), nil, "has been accepted with other content"},
+		{"newer", SignConfEmbedded(key, 11, body2), body2, ""},
+		{"replay of older", SignConfEmbedded(key, 10, body1), nil, "older than accepted 11"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			payload, signed, err := v.Verify(tc.body)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error with %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(payload, tc.payload) {
+				t.Fatalf("expected %s, got %s, %v", tc.payload, payload, err)
+			}
+			// signed form is verifiable by another verifier, e.g. after restart
+			v2, _ := newDynVerifier("dyn.json", []string{hex.EncodeToString(pub)}, 0)
+			if p, _, err := v2.Verify(signed); err != nil || !bytes.Equal(p, tc.payload) {
+				t.Fatalf("signed form can't be verified: %s, %v", p, err)
+			}
+		})
+	}
+}
+
+func TestDynVerifierDetached(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	url := filepath.Join(t.TempDir(), "dyn.json")
+	body := []byte(`{"a":1}`)
+
+	cases := []struct {
+		name string
+		sig  []byte // nil means no .sig file
+		body []byte
+		err  string
+	}{
+		{"no signature", nil, body, "dyn is not signed"},
+		{"bad signature file", []byte(`{"version":1}`), body, "bad signature file"},
+		{"bad signature format", []byte(`{"version":1,"signature":"xyz"}`), body, "bad dyn signature format"},
+		{"signed", SignConfDetached(key, 1, body), body, ""},
+		{"body doesn't match", SignConfDetached(key, 2, body), []byte(`{"a":2}`), "doesn't match"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			os.Remove(url + ".sig")
+			if tc.sig != nil {
+				if err := ioutil.WriteFile(url+".sig", tc.sig, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			v, _ := newDynVerifier(url, []string{hex.EncodeToString(pub)}, 0)
+			payload, signed, err := v.Verify(tc.body)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error with %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(payload, tc.body) {
+				t.Fatalf("expected %s, got %s, %v", tc.body, payload, err)
+			}
+			// cache keeps embedded form, so .sig is not needed to verify it
+			os.Remove(url + ".sig")
+			v2, _ := newDynVerifier(url, []string{hex.EncodeToString(pub)}, 0)
+			if p, _, err := v2.Verify(signed); err != nil || !bytes.Equal(p, tc.body) {
+				t.Fatalf("signed form can't be verified: %s, %v", p, err)
+			}
+		})
+	}
+}
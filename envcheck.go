@@ -0,0 +1,134 @@
+package modern
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+	envconfig silently ignores MYAPP_* variables that match no field,
+	so a typo like MYAPP_HTTPBIMD falls back to default value.
+	we look for such variables and suggest what was probably meant.
+	TrivialSetupConf.FailOnUnknownEnv makes them fatal for production builds
+*/
+
+type UnknownEnvVar struct {
+	Key        string
+	Suggestion string // closest known variable, may be empty
+}
+
+// variables with app prefix that are used by the framework itself, not by struct fields
+var frameworkEnvSuffixes = []string{"DEVMODE"}
+
+// MYAPP_CONF__* are overrides of merged configuration, see confoverlay.go
+var frameworkEnvPrefixes = []string{confEnvOverrideInfix}
+
+func (a *App) knownEnvKeys() map[string]bool {
+	prefix := strings.ToUpper(a.Conf.AppName) + "_"
+	known := map[string]bool{}
+	for _, s := range frameworkEnvSuffixes {
+		known[prefix+s] = true
+	}
+	for _, target := range []interface{}{a.Conf, a.EnvConf} {
+		walkConfFields(a.Conf.AppName, target, func(f *confField) {
+			known[f.EnvKey] = true
+		})
+	}
+	return known
+}
+
+func (a *App) UnknownEnvVars() []*UnknownEnvVar {
+	if a.Conf.AppName == "" {
+		return nil // no prefix, everything would be unknown
+	}
+	prefix := strings.ToUpper(a.Conf.AppName) + "_"
+	known := a.knownEnvKeys()
+	knownList := make([]string, 0, len(known))
+	for k := range known {
+		knownList = append(knownList, k)
+	}
+	sort.Strings(knownList)
+
+	res := []*UnknownEnvVar{}
+	for _, kv := range os.Environ() {
+		key := strings.SplitN(kv, "=", 2)[0]
+		if !strings.HasPrefix(key, prefix) || known[key] || hasAnyPrefix(key[len(prefix):], frameworkEnvPrefixes) {
+			continue
+		}
+		res = append(res, &UnknownEnvVar{Key: key, Suggestion: closestString(key, knownList)})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
+	return res
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns error if there are unknown variables and it's a production build with FailOnUnknownEnv
+func (a *App) checkUnknownEnvVars() error {
+	unknown := a.UnknownEnvVars()
+	for _, u := range unknown {
+		msg := "WARNING: unknown env variable " + u.Key
+		if u.Suggestion != "" {
+			msg += ", did you mean " + u.Suggestion + "?"
+		}
+		if a.envOrigins[u.Key] != "" {
+			msg += " (from " + a.envOrigins[u.Key] + ")"
+		}
+		a.Log.Error(msg)
+	}
+	if len(unknown) > 0 && a.Conf.FailOnUnknownEnv && a.Conf.IsForProduction {
+		keys := []string{}
+		for _, u := range unknown {
+			keys = append(keys, u.Key)
+		}
+		return &SetupError{StageEnv, "unknown env variables: " + strings.Join(keys, ", "), nil}
+	}
+	return nil
+}
+
+// closest candidate by edit distance, empty if nothing is close enough
+func closestString(s string, candidates []string) string {
+	best := ""
+	bestDist := len(s)/4 + 2
+	for _, c := range candidates {
+		if d := levenshtein(s, c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
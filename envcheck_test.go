@@ -0,0 +1,165 @@
+package modern
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rshmelev/gologs/libgologs"
+)
+
+// only Error is used by env checks
+type envCheckLogger struct {
+	libgologs.SomeLogger
+	errors []string
+}
+
+func (l *envCheckLogger) Error(params ...interface{}) {
+	l.errors = append(l.errors, fmt.Sprint(params...))
+}
+
+type envCheckConf struct {
+	DbUrl   string
+	Workers int
+}
+
+func envCheckApp(production, failOnUnknown bool) (*App, *envCheckLogger) {
+	log := &envCheckLogger{}
+	return &App{
+		Conf: &TrivialSetupConf{
+			AppName:          "envtest",
+			IsForProduction:  production,
+			FailOnUnknownEnv: failOnUnknown,
+		},
+		EnvConf:    &envCheckConf{},
+		Log:        log,
+		envOrigins: map[string]string{"ENVTEST_WORKRES": "/app/.env"},
+	}, log
+}
+
+func TestLevenshtein(t *testing.T) {
+	cases := []struct {
+		a, b string
+		dist int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"", "abc", 3},
+		{"abc", "abc", 0},
+		{"abc", "abd", 1},
+		{"abc", "ab", 1},
+		{"kitten", "sitting", 3},
+	}
+	for _, tc := range cases {
+		if d := levenshtein(tc.a, tc.b); d != tc.dist {
+			t.Errorf("levenshtein(%q, %q) = %d, expected %d", tc.a, tc.b, d, tc.dist)
+		}
+	}
+}
+
+func TestClosestString(t *testing.T) {
+	known := []string{"MYAPP_DEVMODE", "MYAPP_HTTPBIND", "MYAPP_LOGSPATH", "MYAPP_STATEFILE"}
+	cases := []struct {
+		in, out string
+	}{
+		{"MYAPP_HTTPBIMD", "MYAPP_HTTPBIND"},
+		{"MYAPP_HTTP_BIND", "MYAPP_HTTPBIND"},
+		{"MYAPP_LOGPATH", "MYAPP_LOGSPATH"},
+		{"MYAPP_STATE_FILES", "MYAPP_STATEFILE"},
+		{"MYAPP_DEVMODE", "MYAPP_DEVMODE"},
+		{"MYAPP_SOMETHINGELSE", ""},
+		{"MYAPP_X", ""},
+	}
+	for _, tc := range cases {
+		if res := closestString(tc.in, known); res != tc.out {
+			t.Errorf("closestString(%q) = %q, expected %q", tc.in, res, tc.out)
+		}
+	}
+	if res := closestString("MYAPP_HTTPBIND", nil); res != "" {
+		t.Errorf("no candidates should give empty string, got %q", res)
+	}
+}
+
+func TestUnknownEnvVars(t *testing.T) {
+	for k, v := range map[string]string{
+		"ENVTEST_HTTPBIMD":      ":80",  // typo of setup conf field
+		"ENVTEST_WORKRES":       "4",    // typo of envconf field
+		"ENVTEST_QWERTYUIOPASD": "x",    // nothing close
+		"ENVTEST_HTTPBIND":      ":80",  // setup conf field
+		"ENVTEST_DBURL":         "db",   // envconf field
+		"ENVTEST_DEVMODE":       "true", // used by framework
+		"ENVTEST_CONF__a__b":    "1",    // override of merged conf
+		"OTHERAPP_HTTPBIMD":     ":80",  // other prefix
+	} {
+		t.Setenv(k, v)
+	}
+
+	a, _ := envCheckApp(false, false)
+	res := map[string]string{}
+	keys := []string{}
+	for _, u := range a.UnknownEnvVars() {
+		res[u.Key] = u.Suggestion
+		keys = append(keys, u.Key)
+	}
+	expected := map[string]string{
+		"ENVTEST_HTTPBIMD":      "ENVTEST_HTTPBIND",
+		"ENVTEST_WORKRES":       "ENVTEST_WORKERS",
+		"ENVTEST_QWERTYUIOPASD": "",
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+	if !reflect.DeepEqual(keys, []string{"ENVTEST_HTTPBIMD", "ENVTEST_QWERTYUIOPASD", "ENVTEST_WORKRES"}) {
+		t.Fatalf("result is not sorted: %v", keys)
+	}
+
+	a.Conf.AppName = ""
+	if res := a.UnknownEnvVars(); res != nil {
+		t.Fatalf("without app name nothing can be checked, got %v", res)
+	}
+}
+
+func TestCheckUnknownEnvVars(t *testing.T) {
+	cases := []struct {
+		name                      string
+		unknown                   bool
+		production, failOnUnknown bool
+		err                       bool
+	}{
+		{"warning only", true, false, false, false},
+		{"fail is for production only", true, false, true, false},
+		{"production without fail", true, true, false, false},
+		{"production with fail", true, true, true, true},
+		{"nothing unknown", false, true, true, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("ENVTEST_HTTPBIND", ":80")
+			if tc.unknown {
+				t.Setenv("ENVTEST_WORKRES", "4")
+			}
+			a, log := envCheckApp(tc.production, tc.failOnUnknown)
+			err := a.checkUnknownEnvVars()
+			if tc.err != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err != nil {
+				se, ok := err.(*SetupError)
+				if !ok || se.Stage != StageEnv || !strings.Contains(se.Error(), "ENVTEST_WORKRES") {
+					t.Fatalf("expected env stage SetupError with variable name, got %v", err)
+				}
+			}
+			if !tc.unknown {
+				if len(log.errors) != 0 {
+					t.Fatalf("nothing should be logged, got %v", log.errors)
+				}
+				return
+			}
+			expected := "WARNING: unknown env variable ENVTEST_WORKRES, did you mean ENVTEST_WORKERS? (from /app/.env)"
+			if !reflect.DeepEqual(log.errors, []string{expected}) {
+				t.Fatalf("expected %q to be logged, got %v", expected, log.errors)
+			}
+		})
+	}
+}
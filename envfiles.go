@@ -0,0 +1,138 @@
+package modern
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+/*
+	.env files are loaded in order, variables that are already set are not overridden,
+	so real env wins over any file and earlier file wins over later ones.
+	relative paths are resolved against AppDir.
+
+	the list can be set with TrivialSetupConf.EnvFiles or MYAPP_ENVFILES (comma separated),
+	TrivialSetupConf.EnvStrict (or MYAPP_ENVSTRICT=true) makes malformed file fatal
+*/
+
+type EnvFileReport struct {
+	File       string
+	Loaded     bool
+	Set        []string // variables set by this file
+	AlreadySet []string // variables of this file that were set before
+	Err        error
+}
+
+func DefaultEnvFiles(c *TrivialSetupConf) []string {
+	return []string{
+		//"sample.env",
+		".env",                                   // default godotenv way
+		c.AppName + ".env",                       // myapp.env
+		c.CompanyName + "-" + c.AppName + ".env", // mycompany-myapp.env
+		c.ConfPath + "/.env",                     // however modernconf stores configs in /conf folder by default...
+		c.ConfPath + "/" + c.AppName + ".env",    // however modernconf stores configs in /conf folder by default...
+		"gitignored.env",                         // something should be definitely gitignored
+	}
+}
+
+// EnvFiles/EnvStrict are needed before env is processed, so real env is checked directly
+func (a *App) envFilesSettings() ([]string, bool, error) {
+	c := a.Conf
+	prefix := strings.ToUpper(c.AppName) + "_"
+
+	files := c.EnvFiles
+	if v := os.Getenv(prefix + "ENVFILES"); v != "" {
+		files = strings.Split(v, ",")
+	}
+	if len(files) == 0 {
+		files = DefaultEnvFiles(c)
+	}
+
+	strict := c.EnvStrict
+	if v := os.Getenv(prefix + "ENVSTRICT"); v != "" {
+		strict = v == "1" || strings.EqualFold(v, "true")
+	}
+
+	resolved := []string{}
+	seen := map[string]bool{}
+	for _, f := range files {
+		f, err := a.Templates.Expand(strings.TrimSpace(f))
+		if err != nil {
+			return nil, false, &SetupError{StageEnv, "bad env file path", err}
+		}
+		if f == "" {
+			continue
+		}
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(a.AppDir, f)
+		}
+		if !seen[f] {
+			seen[f] = true
+			resolved = append(resolved, f)
+		}
+	}
+	return resolved, strict, nil
+}
+
+// returns error only in strict mode
+func (a *App) loadEnvFiles(files []string, strict bool) error {
+	a.envOrigins = map[string]string{}
+	a.envReport = nil
+	for _, file := range files {
+		r := &EnvFileReport{File: file}
+		a.envReport = append(a.envReport, r)
+
+		vars, err := godotenv.Read(file)
+		if err != nil {
+			if _, statErr := os.Stat(file); os.IsNotExist(statErr) {
+				continue
+			}
+			r.Err = err
+			if strict {
+				return &SetupError{StageEnv, "malformed env file " + file, err}
+			}
+			continue
+		}
+
+		r.Loaded = true
+		keys := make([]string, 0, len(vars))
+		for k := range vars {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if _, exists := os.LookupEnv(k); exists {
+				r.AlreadySet = append(r.AlreadySet, k)
+				continue
+			}
+			os.Setenv(k, vars[k])
+			a.envOrigins[k] = file
+			r.Set = append(r.Set, k)
+		}
+	}
+	return nil
+}
+
+// what env files did, call it when logger is ready
+func (a *App) logEnvReport() {
+	for _, r := range a.envReport {
+		switch {
+		case r.Err != nil:
+			a.Log.Error("WARNING: malformed env file ignored: "+r.File+", error: ", r.Err)
+		case r.Loaded:
+			msg := "env file loaded: " + r.File + ", set: " + strings.Join(r.Set, ", ")
+			if len(r.AlreadySet) > 0 {
+				msg += "; already set: " + strings.Join(r.AlreadySet, ", ")
+			}
+			a.Log.Info(msg)
+		}
+	}
+}
+
+// what env files did, see TrivialSetupConf.EnvFiles
+func (a *App) EnvReport() []*EnvFileReport {
+	return a.envReport
+}
@@ -0,0 +1,95 @@
+package modern
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+/*
+	filesystem notifications for local AutoLoadFile sources.
+	the parent folder is watched, not the file, so editors that write a temp file
+	and rename it over the original and kubernetes ConfigMap volumes
+	(file -> ..data/file, where ..data symlink is swapped) are both noticed.
+	if the file itself is a symlink, folder of its target is watched too
+*/
+
+// events that come together (editor writes, renames, chmods) trigger one reload
+const fileWatchDebounce = time.Millisecond * 100
+
+type fileWatcher struct {
+	watcher *fsnotify.Watcher
+	path    string
+	onEvent func()
+
+	mutex sync.Mutex
+	timer *time.Timer
+}
+
+func isLocalPath(url string) bool {
+	return url != "" && url != "-" && !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://")
+}
+
+func watchFile(path string, onEvent func()) (*fileWatcher, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Add(filepath.Dir(abs)); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if target, err := filepath.EvalSymlinks(abs); err == nil && filepath.Dir(target) != filepath.Dir(abs) {
+		w.Add(filepath.Dir(target)) // best effort, folder is watched anyway
+	}
+	fw := &fileWatcher{watcher: w, path: abs, onEvent: onEvent}
+	go fw.loop()
+	return fw, nil
+}
+
+func (fw *fileWatcher) loop() {
+	name := filepath.Base(fw.path)
+	for {
+		select {
+		case e, ok := <-fw.watcher.Events:
+			if !ok {
+				return
+			}
+			base := filepath.Base(e.Name)
+			// detached signature of the file counts too, see dynsign.go
+			if base == name || base == name+".sig" || strings.HasPrefix(base, "..") || e.Name == fw.path {
+				fw.trigger()
+			}
+		case _, ok := <-fw.watcher.Errors:
+			if !ok {
+				return
+			}
+			fw.trigger() // events may be lost, better check
+		}
+	}
+}
+
+func (fw *fileWatcher) trigger() {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+	fw.timer = time.AfterFunc(fileWatchDebounce, fw.onEvent)
+}
+
+func (fw *fileWatcher) Close() error {
+	fw.mutex.Lock()
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+	fw.mutex.Unlock()
+	return fw.watcher.Close()
+}
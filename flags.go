@@ -0,0 +1,165 @@
+package modern
+
+import (
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	every field of TrivialSetupConf and of envconf struct has a command line flag:
+	./app -httpbind :9000   is the same as   MYAPP_HTTPBIND=:9000 ./app
+	flags override env values. nested fields are named like -db.host.
+	if the name is already taken (by the app itself or by TrivialSetupConf), flag is
+	prefixed with app name: -myapp.httpbind. if that is taken too, field has no flag
+*/
+
+type confFlag struct {
+	name  string
+	field *confField
+	def   string
+	value string
+	set   bool
+}
+
+func (f *confFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.def
+}
+
+func (f *confFlag) Set(s string) error {
+	// check that value can be parsed right away so flag package reports it nicely
+	probe := reflect.New(f.field.Value.Type()).Elem()
+	if err := setFieldFromString(probe, s); err != nil {
+		return err
+	}
+	f.value = s
+	f.set = true
+	return nil
+}
+
+func (f *confFlag) IsBoolFlag() bool {
+	return f != nil && f.field != nil && f.field.Value.Kind() == reflect.Bool
+}
+
+type confFlags struct {
+	flags []*confFlag
+}
+
+// defines flags for every field of target, see above for names that are taken
+func defineConfFlags(flags *flag.FlagSet, appname string, target interface{}) *confFlags {
+	res := &confFlags{}
+	walkConfFields(appname, target, func(f *confField) {
+		name := strings.ToLower(f.Path)
+		if flags.Lookup(name) != nil {
+			name = strings.ToLower(appname) + "." + name
+		}
+		if flags.Lookup(name) != nil {
+			return
+		}
+		cf := &confFlag{name: name, field: f, def: f.String()}
+		if f.IsSecret() && cf.def != "" {
+			cf.def = maskedValue
+		}
+		usage := f.Field.Tag.Get("desc")
+		if usage != "" {
+			usage += " "
+		}
+		usage += "(env " + f.EnvKey + ")"
+		flags.Var(cf, name, usage)
+		res.flags = append(res.flags, cf)
+	})
+	return res
+}
+
+// sets fields for flags that were given in command line
+func (s *confFlags) Apply() error {
+	if s == nil {
+		return nil
+	}
+	for _, f := range s.flags {
+		if !f.set {
+			continue
+		}
+		if err := setFieldFromString(f.field.Value, f.value); err != nil {
+			return errors.New("flag -" + f.name + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// parses s the same way envconfig does for the most common types
+func setFieldFromString(v reflect.Value, s string) error {
+	if v.CanAddr() {
+		if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			return u.UnmarshalText([]byte(s))
+		}
+	}
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := strconv.ParseUint(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(i)
+	case reflect.Float32, reflect.Float64:
+		fl, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(fl)
+	case reflect.Slice:
+		parts := []string{}
+		if strings.TrimSpace(s) != "" {
+			parts = strings.Split(s, ",")
+		}
+		sl := reflect.MakeSlice(v.Type(), len(parts), len(parts))
+		for i, p := range parts {
+			if err := setFieldFromString(sl.Index(i), p); err != nil {
+				return err
+			}
+		}
+		v.Set(sl)
+	case reflect.Ptr:
+		p := reflect.New(v.Type().Elem())
+		if err := setFieldFromString(p.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(p)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package modern
+
+import (
+	"flag"
+	"io/ioutil"
+	"testing"
+)
+
+type flagsTestDb struct {
+	Host string
+}
+
+type flagsTestConf struct {
+	HttpBind string
+	Workers  int
+	Db       flagsTestDb
+}
+
+func TestDefineConfFlags(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.String("workers", "", "defined by the app")
+	flags.String("myapp.workers", "", "defined by the app too")
+	setup := defineConfFlags(flags, "myapp", &struct{ HttpBind string }{})
+
+	conf := &flagsTestConf{}
+	res := defineConfFlags(flags, "myapp", conf)
+
+	cases := []struct {
+		flag  string
+		owner *confFlags
+	}{
+		{"httpbind", setup},
+		{"myapp.httpbind", res},
+		{"db.host", res},
+	}
+	for _, tc := range cases {
+		t.Run(tc.flag, func(t *testing.T) {
+			f := flags.Lookup(tc.flag)
+			if f == nil {
+				t.Fatal("flag is not defined")
+			}
+			found := false
+			for _, cf := range tc.owner.flags {
+				found = found || cf == f.Value
+			}
+			if !found {
+				t.Fatal("flag belongs to another struct")
+			}
+		})
+	}
+	for _, cf := range res.flags {
+		if cf.field.Path == "Workers" {
+			t.Fatalf("taken flag is defined as -%s", cf.name)
+		}
+	}
+
+	err := flags.Parse([]string{"-httpbind", ":1", "-myapp.httpbind", ":2", "-db.host", "h", "-workers", "x", "rest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := res.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if conf.HttpBind != ":2" || conf.Db.Host != "h" || conf.Workers != 0 {
+		t.Fatalf("unexpected conf %+v", conf)
+	}
+	if args := flags.Args(); len(args) != 1 || args[0] != "rest" {
+		t.Fatalf("unexpected args %v", args)
+	}
+}
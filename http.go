@@ -3,6 +3,7 @@ package modern
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
@@ -124,6 +125,9 @@ type WebsockLogHandler struct {
 }
 
 func SetupWebsockLogHandler(h *WebsockLogHandler) {
+	if h.Router == nil {
+		return // headless
+	}
 	wss := easyws.SetupWsServer(&easyws.WsServer{
 		Log: func(s string) {
 			h.Logger.Info("WS: ", s)
@@ -163,7 +167,8 @@ func SetupWebsockLogHandler(h *WebsockLogHandler) {
 	go wss.Run()
 
 	h.Router.GET(h.LogsUrlRoot, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		wss.ServeHTTP(w, r)
+		// log viewers are told that server is going away on shutdown
+		wss.ServeHTTP(GoingAwayOnDrain(w, r), r)
 	})
 	h.Logger.WebsocketFunc = func(msg *libgologs.WebsocketLogMsg) {
 		wss.BroadcastJSON(msg)
@@ -176,6 +181,9 @@ func AttachSubdirFileServer(router *httprouter.Router, subdir string, webroot st
 	fileserver := http.FileServer(MakeJustFilesFs(webroot))
 	//fileserver := http.FileServer(http.Dir(webroot))
 	stripped := http.StripPrefix(subdir, fileserver)
+	if router == nil {
+		return stripped // headless
+	}
 	router.GET(subdir+"*some", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		stripped.ServeHTTP(w, r)
 	})
@@ -184,7 +192,9 @@ func AttachSubdirFileServer(router *httprouter.Router, subdir string, webroot st
 
 //=====================================================================================================================
 
-func AttachHealthPointServer(router *httprouter.Router, url string, appName string, version string, dev bool) js.IObject {
+// healthpoint without http server, still useful to collect app status.
+// its time fields are updated until ctx is done
+func NewHealthPoint(ctx context.Context, appName string, version string, dev bool) js.IObject {
 	healthpoint := js.GetSynchronizedWrapper(js.NewEmptyObject())
 	healthpoint.Put("app", appName)
 	healthpoint.Put("version", version)
@@ -193,13 +203,28 @@ func AttachHealthPointServer(router *httprouter.Router, url string, appName stri
 	started := time.Now().UTC()
 	healthpoint.Put("started", started.Format("2006-01-02 15:04:05"))
 	go func() {
-		for _ = range time.Tick(time.Second) {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
 			elapsed := time.Since(started)
 			healthpoint.Put("elapsed", elapsed.String())
 			healthpoint.Put("elapsedsec", int(elapsed.Seconds()))
 			healthpoint.Put("now", time.Now().UTC().Format("2006-01-02 15:04:05"))
 		}
 	}()
+	return healthpoint
+}
+
+func AttachHealthPointServer(router *httprouter.Router, url string, appName string, version string, dev bool) js.IObject {
+	healthpoint := NewHealthPoint(AppContext(), appName, version, dev)
+	if router == nil {
+		return healthpoint // headless
+	}
 	router.GET(url, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		// healthpoint.Put("goroutines", runtime.NumGoroutine())
 		memstats := GetSomeMemStats()
@@ -211,6 +236,9 @@ func AttachHealthPointServer(router *httprouter.Router, url string, appName stri
 }
 
 func AttachHeapDumpHandler(router *httprouter.Router, heapDumpUrl, snapshotsFolder, DownloadPath string) {
+	if router == nil {
+		return // headless
+	}
 	router.GET(heapDumpUrl, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		filename := HeapDump(snapshotsFolder)
 		url := F.AppendSlash(DownloadPath) + path.Base(filename)
@@ -243,9 +271,17 @@ var restartHtmlTemplate = `
 </body>
 </html>
 `
-var restartId string
 
 func AttachShutdownHandler(router *httprouter.Router, url string) {
+	AttachShutdownHandlerFunc(router, url, gointhandler.InterruptTheApp)
+}
+
+// interrupt is called to shut the app down
+func AttachShutdownHandlerFunc(router *httprouter.Router, url string, interrupt func()) {
+	if router == nil {
+		return // headless
+	}
+	var restartId string
 	router.GET(url, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		qsid := r.URL.Query().Get("startid")
 		if qsid == "" {
@@ -262,7 +298,7 @@ func AttachShutdownHandler(router *httprouter.Router, url string) {
 			w.Write([]byte(html))
 			go func() {
 				time.Sleep(time.Second) // ensure response will reach the requestor
-				gointhandler.InterruptTheApp()
+				interrupt()
 			}()
 		} else {
 			ok := "equal"
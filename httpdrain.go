@@ -0,0 +1,389 @@
+package modern
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	graceful shutdown of http server:
+	- stop accepting new connections
+	- tell owners of hijacked (websocket) connections that server is going away, see DrainSignal.
+	  they have HijackedCloseTimeout to say goodbye and close connections, the rest are closed forcibly
+	- wait for in-flight requests until deadline
+	- report requests that were still running when deadline hit
+*/
+
+// used by TrivialStart, TrivialSetupConf.HttpDrainTimeout overrides it
+var HttpDrainTimeout = time.Second * 10
+
+type HttpDrainer struct {
+	Log      SimpleLogFunc
+	ErrorLog SimpleLogFunc
+	// how long owners of hijacked connections have to close them on shutdown, 1s by default
+	HijackedCloseTimeout time.Duration
+
+	mutex     sync.Mutex
+	lastId    int64
+	active    map[int64]*activeHttpRequest
+	hijacked  map[*hijackedConn]bool
+	draining  chan struct{}
+	drainOnce sync.Once
+}
+
+type activeHttpRequest struct {
+	method  string
+	uri     string
+	started time.Time
+}
+
+func (r *activeHttpRequest) String() string {
+	return r.method + " " + r.uri + " (running for " + time.Since(r.started).String() + ")"
+}
+
+type drainSignalKey struct{}
+
+// closed when server starts shutting down: owner of hijacked connection (websocket)
+// should send its close frame and close the connection.
+// never closed if request is not served through HttpDrainer
+func DrainSignal(r *http.Request) <-chan struct{} {
+	ch, _ := r.Context().Value(drainSignalKey{}).(chan struct{})
+	return ch
+}
+
+// for websocket handlers that don't control close codes (easyws etc): when DrainSignal fires,
+// connection hijacked through returned writer gets going away (1001) close frame and is closed
+func GoingAwayOnDrain(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	return &goingAwayWriter{ResponseWriter: w, drain: DrainSignal(r)}
+}
+
+type goingAwayWriter struct {
+	http.ResponseWriter
+	drain <-chan struct{}
+}
+
+func (w *goingAwayWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *goingAwayWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	c, rw, err := h.Hijack()
+	if err != nil || w.drain == nil {
+		return c, rw, err
+	}
+	gc := &goingAwayConn{Conn: c, closed: make(chan struct{})}
+	go gc.watch(w.drain)
+	// handler writes through rw too, so it has to go through gc as well
+	rw.Writer.Reset(gc)
+	return gc, rw, nil
+}
+
+// close frame is written between frames of the handler, see wsFrameTracker
+type goingAwayConn struct {
+	net.Conn
+	writeMutex sync.Mutex
+	frames     wsFrameTracker
+	goingAway  bool // close frame is due at the end of current frame
+	sent       bool
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+// unmasked server frame: FIN + close opcode, payload of status code 1001
+var goingAwayFrame = []byte{0x88, 0x02, 0x03, 0xe9}
+
+func (c *goingAwayConn) watch(drain <-chan struct{}) {
+	select {
+	case <-drain:
+	case <-c.closed:
+		return
+	}
+	c.writeMutex.Lock()
+	c.goingAway = true
+	sent := c.sendGoingAway()
+	c.writeMutex.Unlock()
+	if sent {
+		c.Close()
+	}
+	// otherwise it is sent by Write which completes the frame, or HttpDrainer closes the connection
+}
+
+// call with writeMutex locked
+func (c *goingAwayConn) sendGoingAway() bool {
+	if !c.goingAway || c.sent || !c.frames.atBoundary() {
+		return c.sent
+	}
+	c.sent = true
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.Conn.Write(goingAwayFrame)
+	return true
+}
+
+func (c *goingAwayConn) Write(b []byte) (int, error) {
+	c.writeMutex.Lock()
+	if c.sent {
+		c.writeMutex.Unlock()
+		return 0, errors.New("server is going away")
+	}
+	n, err := c.Conn.Write(b)
+	c.frames.feed(b[:n])
+	sent := c.goingAway && c.sendGoingAway()
+	c.writeMutex.Unlock()
+	if sent {
+		c.Close()
+	}
+	return n, err
+}
+
+func (c *goingAwayConn) Close() error {
+	err := errors.New("connection is already closed")
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// follows outgoing bytes of websocket connection (http upgrade response, then frames)
+// to know where one frame ends, handlers may write a frame in several Write calls
+type wsFrameTracker struct {
+	upgraded bool
+	tail     []byte // end of upgrade response seen so far
+	header   []byte // incomplete frame header
+	left     uint64 // payload bytes left in current frame
+}
+
+func (t *wsFrameTracker) atBoundary() bool {
+	return t.upgraded && len(t.header) == 0 && t.left == 0
+}
+
+func (t *wsFrameTracker) feed(b []byte) {
+	for len(b) > 0 {
+		switch {
+		case !t.upgraded:
+			buf := append(t.tail, b...)
+			i := bytes.Index(buf, []byte("\r\n\r\n"))
+			if i < 0 {
+				if len(buf) > 3 {
+					buf = buf[len(buf)-3:]
+				}
+				t.tail = append([]byte(nil), buf...)
+				return
+			}
+			t.upgraded, t.tail = true, nil
+			b = buf[i+4:]
+		case t.left > 0:
+			n := uint64(len(b))
+			if n > t.left {
+				n = t.left
+			}
+			t.left -= n
+			b = b[n:]
+		default:
+			t.header = append(t.header, b[0])
+			b = b[1:]
+			if size := wsHeaderSize(t.header); size > 0 && len(t.header) == size {
+				t.left = wsPayloadSize(t.header)
+				t.header = t.header[:0]
+			}
+		}
+	}
+}
+
+// 0 if it is not known yet
+func wsHeaderSize(h []byte) int {
+	if len(h) < 2 {
+		return 0
+	}
+	size := 2
+	switch h[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if h[1]&0x80 != 0 {
+		size += 4 // mask
+	}
+	return size
+}
+
+func wsPayloadSize(h []byte) uint64 {
+	switch l := h[1] & 0x7f; l {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(h[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(h[2:10])
+	default:
+		return uint64(l)
+	}
+}
+
+// wraps server handler and ConnState, call it after server.Handler is set
+func AttachHttpDrainer(server *http.Server) *HttpDrainer {
+	d := &HttpDrainer{
+		active:               map[int64]*activeHttpRequest{},
+		hijacked:             map[*hijackedConn]bool{},
+		draining:             make(chan struct{}),
+		HijackedCloseTimeout: time.Second,
+		Log: func(params ...interface{}) {
+			log.Println(params...)
+		},
+		ErrorLog: func(params ...interface{}) {
+			log.Println(append([]interface{}{"ERROR:"}, params...)...)
+		},
+	}
+
+	server.Handler = d.Wrap(server.Handler)
+	server.RegisterOnShutdown(d.CloseHijacked)
+
+	return d
+}
+
+func (d *HttpDrainer) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.mutex.Lock()
+		d.lastId++
+		id := d.lastId
+		d.active[id] = &activeHttpRequest{method: r.Method, uri: r.RequestURI, started: time.Now()}
+		d.mutex.Unlock()
+
+		defer func() {
+			d.mutex.Lock()
+			delete(d.active, id)
+			d.mutex.Unlock()
+		}()
+
+		r = r.WithContext(context.WithValue(r.Context(), drainSignalKey{}, d.draining))
+		h.ServeHTTP(&drainResponseWriter{ResponseWriter: w, d: d}, r)
+	})
+}
+
+// server does not track hijacked connections, so we do it here
+type drainResponseWriter struct {
+	http.ResponseWriter
+	d *HttpDrainer
+}
+
+func (w *drainResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *drainResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	c, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	hc := &hijackedConn{Conn: c, d: w.d}
+	w.d.mutex.Lock()
+	w.d.hijacked[hc] = true
+	w.d.mutex.Unlock()
+	return hc, rw, nil
+}
+
+type hijackedConn struct {
+	net.Conn
+	d *HttpDrainer
+}
+
+func (c *hijackedConn) Close() error {
+	c.d.mutex.Lock()
+	delete(c.d.hijacked, c)
+	c.d.mutex.Unlock()
+	return c.Conn.Close()
+}
+
+func (d *HttpDrainer) hijackedCount() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.hijacked)
+}
+
+// descriptions of requests that are being served right now, oldest first
+func (d *HttpDrainer) Active() []string {
+	d.mutex.Lock()
+	list := make([]*activeHttpRequest, 0, len(d.active))
+	for _, r := range d.active {
+		list = append(list, r)
+	}
+	d.mutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].started.Before(list[j].started) })
+	res := make([]string, len(list))
+	for i, r := range list {
+		res[i] = r.String()
+	}
+	return res
+}
+
+// signals owners of hijacked connections (see DrainSignal), waits HijackedCloseTimeout
+// for them to close connections and closes the rest
+func (d *HttpDrainer) CloseHijacked() {
+	d.drainOnce.Do(func() {
+		close(d.draining)
+	})
+	deadline := time.Now().Add(d.HijackedCloseTimeout)
+	for d.hijackedCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	d.mutex.Lock()
+	conns := make([]*hijackedConn, 0, len(d.hijacked))
+	for c := range d.hijacked {
+		conns = append(conns, c)
+	}
+	d.hijacked = map[*hijackedConn]bool{}
+	d.mutex.Unlock()
+
+	if len(conns) > 0 {
+		d.Log("closing hijacked connections forcibly: ", len(conns))
+	}
+	for _, c := range conns {
+		c.Conn.Close()
+	}
+}
+
+// Drain stops accepting connections and waits for active requests,
+// on deadline remaining requests are reported and connections are closed forcibly
+func (d *HttpDrainer) Drain(ctx context.Context, server *http.Server, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := server.Shutdown(ctx)
+	if err == nil {
+		d.Log("http server has been drained")
+		return nil
+	}
+
+	active := d.Active()
+	d.ErrorLog("http drain deadline hit, requests still running: ", len(active))
+	for _, r := range active {
+		d.ErrorLog("  still running: " + r)
+	}
+	server.Close()
+	return err
+}
@@ -0,0 +1,94 @@
+package modern
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const wsTestUpgrade = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+
+func TestWsFrameTracker(t *testing.T) {
+	long := append([]byte{0x82, 126, 0x01, 0x00}, make([]byte, 256)...)
+	cases := []struct {
+		name     string
+		writes   []string
+		boundary bool
+	}{
+		{"upgrade is not finished", []string{wsTestUpgrade[:20]}, false},
+		{"upgrade split", []string{wsTestUpgrade[:len(wsTestUpgrade)-3], wsTestUpgrade[len(wsTestUpgrade)-3:]}, true},
+		{"whole frame", []string{wsTestUpgrade, "\x81\x02hi"}, true},
+		{"frame with upgrade", []string{wsTestUpgrade + "\x81\x02hi"}, true},
+		{"header only", []string{wsTestUpgrade, "\x81\x02"}, false},
+		{"header then payload", []string{wsTestUpgrade, "\x81\x02", "hi"}, true},
+		{"split header", []string{wsTestUpgrade, "\x82", "\x02hi"}, true},
+		{"extended length", []string{wsTestUpgrade, string(long[:100]), string(long[100:])}, true},
+		{"extended length incomplete", []string{wsTestUpgrade, string(long[:200])}, false},
+		{"masked", []string{wsTestUpgrade, "\x81\x82\x01\x02\x03\x04hi"}, true},
+		{"two frames", []string{wsTestUpgrade, "\x81\x02hi\x81\x03", "hey"}, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var ft wsFrameTracker
+			for _, w := range tc.writes {
+				ft.feed([]byte(w))
+			}
+			if ft.atBoundary() != tc.boundary {
+				t.Fatalf("expected boundary %v", tc.boundary)
+			}
+		})
+	}
+}
+
+func TestGoingAwayOnDrain(t *testing.T) {
+	release := make(chan struct{})
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, _, err := GoingAwayOnDrain(w, r).(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		c.Write([]byte(wsTestUpgrade))
+		c.Write([]byte("\x81\x05"))
+		<-release // drain happens in the middle of the frame
+		c.Write([]byte("hello"))
+		io.Copy(ioutil.Discard, c)
+	}))
+	d := AttachHttpDrainer(s.Config)
+	d.HijackedCloseTimeout = time.Second * 5
+	s.Start()
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+
+	drained := make(chan struct{})
+	go func() {
+		d.CloseHijacked()
+		close(drained)
+	}()
+	time.Sleep(time.Millisecond * 100)
+	close(release)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	b, _ := ioutil.ReadAll(bufio.NewReader(conn))
+	expected := []byte(wsTestUpgrade + "\x81\x05hello\x88\x02\x03\xe9")
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected %q, got %q", expected, b)
+	}
+	select {
+	case <-drained:
+	case <-time.After(time.Second * 2):
+		t.Fatal("connection is not closed after close frame")
+	}
+}
@@ -0,0 +1,173 @@
+package modern
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	interrupts "github.com/rshmelev/go-inthandler"
+)
+
+/*
+	lifecycle = root context + shutdown hooks.
+
+	components register hooks in the order they start,
+	hooks are executed in reverse order (last started - first stopped).
+	every hook has its own timeout, but all of them together
+	can't take more than interrupts.MaxTimeToWaitForCleanup
+
+	AppLifecycle.OnShutdown("db", func(ctx context.Context) error {
+		return db.Close()
+	})
+*/
+
+type ShutdownHook func(ctx context.Context) error
+
+type shutdownHookEntry struct {
+	name    string
+	timeout time.Duration
+	hook    ShutdownHook
+}
+
+type Lifecycle struct {
+	Log      SimpleLogFunc
+	ErrorLog SimpleLogFunc
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex    sync.Mutex
+	hooks    []*shutdownHookEntry
+	stopping bool
+	done     chan struct{}
+}
+
+var ErrShutdownHookTimeout = errors.New("shutdown hook timed out")
+
+// lifecycle used by TrivialSetup/TrivialStart
+var AppLifecycle = NewLifecycle()
+
+// root context of the app, it is cancelled on interrupt
+func AppContext() context.Context {
+	return AppLifecycle.Context()
+}
+
+func NewLifecycle() *Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Lifecycle{
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		Log: func(params ...interface{}) {
+			log.Println(params...)
+		},
+		ErrorLog: func(params ...interface{}) {
+			log.Println(append([]interface{}{"ERROR:"}, params...)...)
+		},
+	}
+}
+
+func (l *Lifecycle) Context() context.Context {
+	return l.ctx
+}
+
+// closed when all shutdown hooks are finished
+func (l *Lifecycle) Done() <-chan struct{} {
+	return l.done
+}
+
+func (l *Lifecycle) IsStopping() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.stopping
+}
+
+// hook timeout is interrupts.MaxTimeToWaitForCleanup
+func (l *Lifecycle) OnShutdown(name string, hook ShutdownHook) {
+	l.OnShutdownWithTimeout(name, 0, hook)
+}
+
+func (l *Lifecycle) OnShutdownWithTimeout(name string, timeout time.Duration, hook ShutdownHook) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.hooks = append(l.hooks, &shutdownHookEntry{name: name, timeout: timeout, hook: hook})
+}
+
+// Shutdown cancels root context and runs the hooks, it is safe to call it many times:
+// only first call runs hooks, others just wait for them
+func (l *Lifecycle) Shutdown() {
+	l.mutex.Lock()
+	if l.stopping {
+		l.mutex.Unlock()
+		<-l.done
+		return
+	}
+	l.stopping = true
+	hooks := l.hooks
+	l.mutex.Unlock()
+
+	l.cancel()
+
+	var deadline time.Time
+	if interrupts.MaxTimeToWaitForCleanup > 0 {
+		deadline = time.Now().Add(interrupts.MaxTimeToWaitForCleanup)
+	}
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		h := hooks[i]
+		if err := l.runHook(h, deadline); err != nil {
+			l.ErrorLog("shutdown of "+h.name+" failed: ", err)
+		}
+	}
+
+	l.Log("all shutdown hooks are done")
+	close(l.done)
+}
+
+func (l *Lifecycle) runHook(h *shutdownHookEntry, deadline time.Time) error {
+	timeout := h.timeout
+	if !deadline.IsZero() {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return ErrShutdownHookTimeout
+		}
+		if timeout == 0 || timeout > left {
+			timeout = left
+		}
+	}
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	l.Log("shutting down: " + h.name)
+	res := make(chan error, 1)
+	go func() {
+		res <- h.hook(ctx)
+	}()
+
+	select {
+	case err := <-res:
+		return err
+	case <-ctx.Done():
+		return ErrShutdownHookTimeout
+	}
+}
+
+// runs Shutdown when go-inthandler reports interrupt
+func (l *Lifecycle) WatchInterrupts(stopChannel chan struct{}) {
+	if stopChannel == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-stopChannel:
+			l.Shutdown()
+		case <-l.ctx.Done():
+		}
+	}()
+}
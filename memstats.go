@@ -8,7 +8,7 @@ import (
 	js "github.com/rshmelev/go-json-light"
 )
 
-var memtracking bool
+var memtrackingOnce sync.Once
 var memtrackingMutex sync.RWMutex
 var someMemStats js.IObject
 
@@ -22,12 +22,13 @@ func GetSomeMemStats() js.IObject {
 	return someMemStats
 }
 
+// every App calls it, stats are tracked once per process
 func TrackMemStats() {
+	memtrackingOnce.Do(trackMemStats)
+}
+
+func trackMemStats() {
 	sleepTime := time.Second
-	if memtracking {
-		return
-	}
-	memtracking = true
 	go func() {
 		memStats := &runtime.MemStats{}
 		lastSampleTime := time.Now()
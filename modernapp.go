@@ -1,29 +1,17 @@
 package modern
 
 import (
-	"flag"
 	stdlog "log"
-	"math/rand"
 	"net/http"
 	"os"
-	"path/filepath"
-	"regexp"
 	"runtime"
 	"runtime/debug"
-	"strconv"
 	"strings"
 	"time"
 
-	"github.com/joho/godotenv"
 	"github.com/julienschmidt/httprouter"
-	"github.com/kelseyhightower/envconfig"
-	. "github.com/rshmelev/go-initstruct"
-	interrupts "github.com/rshmelev/go-inthandler"
 	js "github.com/rshmelev/go-json-light"
-	. "github.com/rshmelev/go-ternary/if"
 	"github.com/rshmelev/gologs/libgologs"
-	"github.com/rshmelev/installasservice"
-	"github.com/rshmelev/restarter/librestarter"
 	//"github.com/spacemonkeygo/monitor" <- does not compile for 386
 )
 
@@ -74,7 +62,7 @@ func HeapDump(path string) string {
 // ease of use of "useful functions"
 var f = F
 
-// we configure github.com/rshmelev/go-inthandler to use these things
+// we configure github.com/rshmelev/go-inthandler to use these things (see App for the modern way)
 var Stop bool = false
 var StopChannel chan struct{}
 
@@ -97,230 +85,115 @@ type TrivialSetupConf struct {
 	MonitorsUrl       string
 	HeapDumpUrl       string
 	KillUrl           string
+	ConfigDumpURL     string // effective configuration with sources, secrets are masked, needs AdminToken
+	// admin api for dyn, local and state, enabled only if AdminToken is set too, see admin.go
+	AdminURL   string
+	AdminToken string
+	// json line per admin mutation, default is LogsPath/FullName.audit.log, "-" disables it
+	AdminAuditLog string
 
 	// these options have default values
 	StaticContentRootURL string
 	HealthPointURL       string `init:"/infohub"`
+	VersionURL           string `init:"/version"`
 	LogsPath             string `init:"{{ .AppDir }}/logs"`
 	ConfPath             string `init:"{{ .AppDir }}/conf"`
 
 	StateFile     string `init:"default"`
 	LocalConfFile string
 	DynConfUrl    string
+	// LocalConfFile is reloaded when it changes
+	LocalConfHotReload bool
+	// expand templates in dyn like in local, see template.go
+	ExpandDynTemplates bool
+	// ed25519 public keys (base64 or hex), if set dyn has to be signed with one of them
+	DynSigningKeys []string
+	// last known good dyn is kept here, ConfPath/dyn.cache.json by default, "-" disables it,
+	// see ModernConf.DynCacheFile
+	DynCacheFile      string
+	DynStartupTimeout time.Duration
+	// retry backoff of dyn and local hot reload, 2m and 0.1 by default, negative jitter disables it
+	DynMaxBackoff time.Duration
+	DynJitter     float64
+
+	// json schemas of dyn, local and state: file, url or the schema itself
+	DynSchema   string
+	LocalSchema string
+	StateSchema string
 
 	IsForProduction bool
+
+	// env files in the order of loading, relative to AppDir, see DefaultEnvFiles
+	EnvFiles []string
+	// malformed env file is fatal
+	EnvStrict bool
+	// unknown MYAPP_* env variables are fatal for production builds
+	FailOnUnknownEnv bool
+
+	// no http router, healthpoint and listener - for batch workers and cli tools.
+	// with AdminURL App.Router has admin api only, the app can serve it on its own
+	Headless bool
+
+	// how long to wait for in-flight http requests on shutdown
+	HttpDrainTimeout time.Duration
 }
 
+// compatibility shims, they are filled by the App that is integrated with the process,
+// see App fields for per-app values
+
 // company + appname + version + buildtime
 var FullAppString = ""
 var StdLogFlags = stdlog.Lshortfile
 var AppDir = "."
 var Debug = false
 
+// same as TryTrivialSetup, but exits the process on error
 func TrivialSetup(envconf interface{}, c *TrivialSetupConf) (libgologs.SomeLogger, *ModernConf, *httprouter.Router, *http.Server, js.IObject) {
-
-	if IsForProductionRequest() {
-		AnswerIsForProduction(c.IsForProduction)
-	}
-
-	if matched, err := regexp.Match("go-build\\d+.+", []byte(os.Args[0])); !matched && err == nil {
-		if appdir, err := filepath.Abs(filepath.Dir(os.Args[0])); err == nil {
-			AppDir = appdir
-		}
-	}
-
-	InitZeroFieldsRecursively(c)
-
-	Debug = false
-	rand.Seed(time.Now().UTC().UnixNano())
-
-	fullname := c.CompanyName + "-" + c.AppName
-	if c.CompanyName == "" {
-		fullname = c.AppName
-	}
-
-	FullAppString = fullname + " v" + c.Version +
-		If(!c.IsForProduction).Then(" (DEBUG)").Else("").Str()
-	FullAppString += If(c.BuildTime != "").Then(" built on " + c.BuildTime).Else("").Str()
-	FullAppString += If(c.GoVersion != "").Then(" (" + c.GoVersion + ")").Else("").Str()
-
-	if c.CodeRev != "" && len(c.CodeRev) > 6 {
-		mod := ""
-		if c.ModifiedSources != "" {
-			mods := strings.Split(c.ModifiedSources, "\n")
-			firstmods := mods
-			if len(mods) > 3 {
-				firstmods = mods[:3]
-				mods = mods[3:]
-			} else {
-				mods = []string{}
-			}
-			mod = strings.Join(firstmods, ", ") +
-				If(len(mods) > 0).Then(
-					" and "+strconv.Itoa(len(mods))+" more").Else("").Str()
-			if len(mod) > 0 {
-				mod = " + modified " + mod
-			}
-		}
-
-		FullAppString += " (rev=" + c.CodeRev[:6] + mod + ")"
-	}
-
-	//_ = godotenv.Load("sample.env")
-	_ = godotenv.Load(".env")                                   // default godotenv way
-	_ = godotenv.Load(c.AppName + ".env")                       // myapp.env
-	_ = godotenv.Load(c.CompanyName + "-" + c.AppName + ".env") // mycompany-myapp.env
-	_ = godotenv.Load(c.ConfPath + "/.env")                     // however modernconf stores configs in /conf folder by default...
-	_ = godotenv.Load(c.ConfPath + "/" + c.AppName + ".env")    // however modernconf stores configs in /conf folder by default...
-	_ = godotenv.Load("gitignored.env")                         // something should be definitely gitignored
-
-	//TrivialSetupConf
-	if enverr := envconfig.Process(c.AppName, c); enverr != nil {
-		stdlog.Fatalln("envconfig.Process of TrivialSetupConf failed: ", enverr)
-	}
-
-	// cool simple autoreplace of {{ .AppDir }}
-	c_map := js.StructToMapOrDie(c)
-	c_new, _ := js.NewObjectFromString(replaceAppDir(c_map.ToString()))
-	c_new.FillStruct(&c)
-
-	flag.Bool("v", false, "get version")
-	fullLogsPath := flag.String("logto", c.LogsPath+"/"+fullname+".log", "full path of rotating log")
-	flag.Parse()
-	probablyOutputVersion()
-
-	installasservice.ProbablyInstallAsService(&installasservice.ServiceInstallerOptions{
-		MaxShutdownTime: interrupts.MaxTimeToWaitForCleanup,
-		AppName:         c.AppName,
-		CompanyName:     c.CompanyName,
-	})
-
-	interrupts.StopPointer = &Stop
-	StopChannel = interrupts.StopChannel
-	librestarter.ProbablyBecomeRestarter(librestarter.RestarterOptions{
-		ShutdownURL:             "http://" + c.HttpBind + c.KillUrl,
-		MaxTimeToWaitForCleanup: &interrupts.MaxTimeToWaitForCleanup,
-		Stop:        interrupts.StopPointer,
-		StopChannel: interrupts.StopChannel,
-	})
-
-	Debug = os.Getenv(strings.ToUpper(c.AppName)+"_DEVMODE") == "1"
-	dev := Debug
-
-	UseAllCores()
-	TrackMemStats()
-
-	if c.LogsPath != "-" {
-		if err := os.MkdirAll(c.LogsPath, 0755); err != nil {
-			stdlog.Fatalln("cannot create logs folder: " + c.LogsPath)
-		}
-	} else {
-		*fullLogsPath = ""
-	}
-	logconf := &libgologs.CoolLogger{
-		FullLogFilename: *fullLogsPath,
-		MemoryLimit:     5000,
-	}
-	log := libgologs.NewCoolLogger(logconf) //defer log.Flush()
-	log.SetAsStdLogWriter(StdLogFlags)
-	stdlog.Println("std log package integration check...")
-
-	log.Info("starting " + FullAppString)
-	if c.CompanySite != "" {
-		log.Info("get more info about " + c.AppName + " at http://" + c.CompanySite)
-	}
-	if !c.IsForProduction {
-		LogNotForProductionMessage()
-	}
-
-	mconf := SetupConf(c.ConfPath, &ModernConf{
-		DevMode:       dev,
-		Log:           log.Info,
-		ErrorLog:      log.Error,
-		StateFile:     c.StateFile,
-		LocalConfFile: c.LocalConfFile,
-		DynConfUrl:    c.DynConfUrl,
-	})
-
-	if envconf != nil {
-		if e := envconfig.Process(c.AppName, envconf); e != nil {
-			log.Error("envconfig.Process failed: ", e)
-			os.Exit(1)
-		}
-	}
-
-	// TODO: what if i do not want http server?
-	s := &http.Server{
-		Addr: c.HttpBind,
-	}
-
-	server, router, _, _ := SetupHttpServer(dev, s, log,
-		GetAccessLogHandler(log,
-			[]string{c.StaticContentRootURL},
-			map[string]bool{c.HealthPointURL: true, c.MonitorsUrl: true, c.WebsocketLogsRoot: true}))
-
-	if good(c.WebsocketLogsRoot) {
-		SetupWebsockLogHandler(&WebsockLogHandler{Router: router, LogsUrlRoot: c.WebsocketLogsRoot, Logger: logconf})
-	}
-
-	if good(c.HeapDumpUrl) {
-		snapshotsFolder := f.AppendSlash(c.StaticContentRoot) + "heapdumps"
-		os.MkdirAll(snapshotsFolder, 755)
-		AttachHeapDumpHandler(router, c.HeapDumpUrl, snapshotsFolder, c.StaticContentRootURL+"heapdumps")
-	}
-
-	if good(c.KillUrl) {
-		AttachShutdownHandler(router, c.KillUrl)
-	}
-
-	AttachSubdirFileServer(router, c.StaticContentRootURL, c.StaticContentRoot)
-
-	if good(c.MonitorsUrl) {
-		router.GET(c.MonitorsUrl, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-			//monitor.DefaultStore.ServeHTTP(w, r)
-			w.Write([]byte("monitors not available"))
-		})
+	log, mconf, router, server, healthpoint, err := TryTrivialSetup(envconf, c)
+	if err != nil {
+		exitOnSetupError(log, err)
 	}
-
-	healthpoint := AttachHealthPointServer(router, c.HealthPointURL, fullname, c.Version, dev)
-	healthpoint.Put("buildtime", c.BuildTime)
-
 	return log, mconf, router, server, healthpoint
 }
 
+// returns *SetupError if something went wrong
+func TryTrivialSetup(envconf interface{}, c *TrivialSetupConf) (libgologs.SomeLogger, *ModernConf, *httprouter.Router, *http.Server, js.IObject, error) {
+	app, err := NewApp(WithConf(c), WithEnvConf(envconf))
+	DefaultApp = app
+	return app.Log, app.ModernConf, app.Router, app.Server, app.HealthPoint, err
+}
+
 func good(s string) bool {
 	return s != "" && s != "-"
 }
 
 // call TrivialStart after you finish configuration of logger, server, router, etc. -
+// router and server are nil in headless mode, that's fine
+// exits the process on error, see TryTrivialStart
 func TrivialStart(log libgologs.SomeLogger, conf *ModernConf, router *httprouter.Router, server *http.Server) error {
-	err := conf.LoadAll()
-	if err != nil {
-		log.Error(err)
-		log.Flush()
-		os.Exit(1)
+	if err := TryTrivialStart(log, conf, router, server); err != nil {
+		exitOnSetupError(log, err)
 	}
-
-	go func() {
-		log.Info("HTTP server is listening ", server.Addr)
-		err := server.ListenAndServe()
-		if err != nil {
-			log.Error("HTTP Server failed with error: ", err)
-			interrupts.InterruptTheApp()
-		}
-	}()
-
-	// before this moment, better to have some ctrl+c
-	interrupts.TakeCareOfInterrupts(false)
-
 	return nil
 }
 
-func probablyOutputVersion() {
-	if len(os.Args) > 1 && os.Args[1] == "-v" {
-		println(FullAppString)
-		os.Exit(0)
+// returns *SetupError if conf can't be loaded or http listener can't be bound
+func TryTrivialStart(log libgologs.SomeLogger, conf *ModernConf, router *httprouter.Router, server *http.Server) error {
+	app := DefaultApp
+	if app == nil || app.ModernConf != conf {
+		// not created by TrivialSetup
+		app = &App{
+			Log:                log,
+			ModernConf:         conf,
+			F:                  F,
+			Lifecycle:          AppLifecycle,
+			DrainTimeout:       HttpDrainTimeout,
+			processIntegration: true,
+		}
 	}
+	app.Router = router
+	app.Server = server
+	return app.Start()
 }
 
 func env(s, appname string) string {
@@ -328,11 +201,6 @@ func env(s, appname string) string {
 	return os.ExpandEnv(s)
 }
 
-func replaceAppDir(s string) string {
-	d := strings.Replace(AppDir, "\\", "\\\\", -1)
-	return strings.Replace(s, "{{ .AppDir }}", d, -1)
-}
-
 func LogNotForProductionMessage() {
 	stdlog.Println("")
 	stdlog.Println("")
@@ -347,6 +215,7 @@ func LogNotForProductionMessage() {
 	stdlog.Println("")
 }
 
+// see also __is_for_production command
 func IsForProductionRequest() bool {
 	args := os.Args
 	q := false
@@ -0,0 +1,71 @@
+package modern
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	js "github.com/rshmelev/go-json-light"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+/*
+	json schema for every source of ModernConf:
+
+	DynSchema:   "{{ .AppDir }}/conf/dyn.schema.json"    file or http(s) url
+	LocalSchema: `{"type": "object", "required": ["db"]}` or the schema itself
+
+	local.json that doesn't match the schema is fatal,
+	dyn.json update that doesn't match is refused and the previous one stays active,
+	state.json that doesn't match is fatal too (the file is left as is),
+	and state changes that don't match are not saved
+*/
+
+type schemaValidator struct {
+	source string
+	schema *gojsonschema.Schema
+}
+
+func loadSchema(source string, timeout time.Duration) (*schemaValidator, error) {
+	if source == "" || source == "-" {
+		return nil, nil
+	}
+	var loader gojsonschema.JSONLoader
+	if strings.HasPrefix(strings.TrimSpace(source), "{") {
+		loader = gojsonschema.NewStringLoader(source)
+	} else {
+		r := F.GetByteContents(source, timeout)
+		if r.Err != nil {
+			return nil, errors.New("cannot load json schema " + source + ": " + r.Err.Error())
+		}
+		if r.Code != 200 {
+			return nil, errors.New(fmt.Sprint("got sad HTTP code ", r.Code, " while loading json schema ", source))
+		}
+		loader = gojsonschema.NewBytesLoader(r.Body)
+	}
+	schema, err := gojsonschema.NewSchema(loader)
+	if err != nil {
+		return nil, errors.New("bad json schema " + source + ": " + err.Error())
+	}
+	return &schemaValidator{source: source, schema: schema}, nil
+}
+
+// nil validator accepts everything
+func (s *schemaValidator) Validate(j js.IReadonlyObject) error {
+	if s == nil || j == nil {
+		return nil
+	}
+	res, err := s.schema.Validate(gojsonschema.NewBytesLoader(j.ToByteArray(0)))
+	if err != nil {
+		return err
+	}
+	if res.Valid() {
+		return nil
+	}
+	problems := []string{}
+	for _, e := range res.Errors() {
+		problems = append(problems, e.Field()+": "+e.Description())
+	}
+	return errors.New("does not match json schema: " + strings.Join(problems, "; "))
+}
@@ -0,0 +1,231 @@
+package modern
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	js "github.com/rshmelev/go-json-light"
+	"github.com/rshmelev/gologs/libgologs"
+)
+
+/*
+	values of TrivialSetupConf, envconf struct, env overrides and local.json may refer to secrets:
+
+	MYAPP_DB_PASSWORD=file:///run/secrets/db     content of the file, trailing newline is trimmed
+	MYAPP_DB_PASSWORD=env://VAULT_DB_PASSWORD    value of another env variable
+	"apikey": "exec://pass show myapp/apikey"    stdout of the command (sh -c, cmd /C on windows)
+
+	dyn.json comes from the network, so references in it are never resolved and stay as is.
+
+	resolved values and values of secret-looking fields are remembered
+	and replaced with ****** in logs, healthpoint and config dumps
+*/
+
+const (
+	SecretRefFile = "file://"
+	SecretRefEnv  = "env://"
+	SecretRefExec = "exec://"
+)
+
+var SecretExecTimeout = time.Second * 10
+
+// shorter values are not redacted, otherwise every "1" in logs would be masked
+const minRedactedSecretLen = 4
+
+var secrets = struct {
+	sync.RWMutex
+	values map[string]bool
+}{values: map[string]bool{}}
+
+func IsSecretRef(s string) bool {
+	return strings.HasPrefix(s, SecretRefFile) || strings.HasPrefix(s, SecretRefEnv) || strings.HasPrefix(s, SecretRefExec)
+}
+
+// returns s as is if it's not a secret reference
+func ResolveSecretRef(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, SecretRefFile):
+		b, err := ioutil.ReadFile(strings.TrimPrefix(s, SecretRefFile))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case strings.HasPrefix(s, SecretRefEnv):
+		key := strings.TrimPrefix(s, SecretRefEnv)
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			return "", errors.New("env variable is not set: " + key)
+		}
+		return v, nil
+	case strings.HasPrefix(s, SecretRefExec):
+		return execSecret(strings.TrimPrefix(s, SecretRefExec))
+	}
+	return s, nil
+}
+
+func execSecret(command string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return "", errors.New("command failed: " + command + ": " + err.Error())
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return "", errors.New("command failed: " + command + ": " + err.Error())
+		}
+	case <-time.After(SecretExecTimeout):
+		cmd.Process.Kill()
+		return "", errors.New("command timed out: " + command)
+	}
+	return strings.TrimRight(out.String(), "\r\n"), nil
+}
+
+// value will be masked in logs, healthpoint and config dumps
+func RegisterSecret(v string) {
+	if len(v) < minRedactedSecretLen {
+		return
+	}
+	secrets.Lock()
+	secrets.values[v] = true
+	secrets.Unlock()
+}
+
+func RedactSecrets(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	for v := range secrets.values {
+		if strings.Contains(s, v) {
+			s = strings.Replace(s, v, maskedValue, -1)
+		}
+	}
+	return s
+}
+
+// resolves references in string (and []string) fields of config struct
+func resolveStructSecrets(appname string, s interface{}) error {
+	var err error
+	walkConfFields(appname, s, func(f *confField) {
+		if err != nil {
+			return
+		}
+		err = resolveValueSecrets(f.Path, f.Value, f.IsSecret())
+	})
+	return err
+}
+
+func resolveValueSecrets(path string, v reflect.Value, secret bool) error {
+	switch v.Kind() {
+	case reflect.String:
+		s := v.String()
+		if !IsSecretRef(s) {
+			if secret {
+				RegisterSecret(s)
+			}
+			return nil
+		}
+		res, err := ResolveSecretRef(s)
+		if err != nil {
+			return errors.New("cannot resolve secret for " + path + ": " + err.Error())
+		}
+		RegisterSecret(res)
+		v.SetString(res)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := resolveValueSecrets(path, v.Index(i), secret); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// returns new object where secret references are resolved
+func resolveJSONSecrets(o js.IObject) (js.IObject, error) {
+	return mapJSONStrings(o, "", func(path, s string) (string, error) {
+		if !IsSecretRef(s) {
+			if secretFieldRx.MatchString(path) {
+				RegisterSecret(s)
+			}
+			return s, nil
+		}
+		res, err := ResolveSecretRef(s)
+		if err != nil {
+			return "", errors.New("cannot resolve secret at " + F.OptString(path, "(root)") + ": " + err.Error())
+		}
+		RegisterSecret(res)
+		return res, nil
+	})
+}
+
+// remembers values of secret-looking fields for redaction, references are not resolved
+func registerJSONSecrets(o js.IReadonlyObject) {
+	v, err := decodeJSONBytes(o.ToByteArray(0))
+	if err != nil {
+		return
+	}
+	mapJSONValue("", v, func(path, s string) (string, error) {
+		if secretFieldRx.MatchString(path) {
+			RegisterSecret(s)
+		}
+		return s, nil
+	})
+}
+
+//=======================================================================
+
+// logger that masks known secrets
+type redactingLogger struct {
+	libgologs.SomeLogger
+}
+
+func redactParams(params []interface{}) []interface{} {
+	res := make([]interface{}, len(params))
+	for i, p := range params {
+		res[i] = p
+		s := fmt.Sprint(p)
+		if r := RedactSecrets(s); r != s {
+			res[i] = r
+		}
+	}
+	return res
+}
+
+func (l *redactingLogger) Info(params ...interface{})  { l.SomeLogger.Info(redactParams(params)...) }
+func (l *redactingLogger) Error(params ...interface{}) { l.SomeLogger.Error(redactParams(params)...) }
+func (l *redactingLogger) Warn(params ...interface{})  { l.SomeLogger.Warn(redactParams(params)...) }
+func (l *redactingLogger) Debug(params ...interface{}) { l.SomeLogger.Debug(redactParams(params)...) }
+
+// writer for std log package that masks known secrets
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, RedactSecrets(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,48 @@
+package modern
+
+import (
+	stdlog "log"
+	"os"
+
+	"github.com/rshmelev/gologs/libgologs"
+)
+
+// stage of TryTrivialSetup/TryTrivialStart that failed
+type SetupStage string
+
+const (
+	StageEnv    SetupStage = "env"
+	StageLogs   SetupStage = "logs"
+	StageConf   SetupStage = "conf"
+	StageListen SetupStage = "listen"
+
+	StageComponents SetupStage = "components"
+)
+
+type SetupError struct {
+	Stage   SetupStage
+	Message string
+	Err     error
+}
+
+func (e *SetupError) Error() string {
+	msg := string(e.Stage) + " stage: " + e.Message
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *SetupError) Unwrap() error {
+	return e.Err
+}
+
+// keeps old behaviour of TrivialSetup/TrivialStart
+func exitOnSetupError(log libgologs.SomeLogger, err error) {
+	if log == nil {
+		stdlog.Fatalln(err)
+	}
+	log.Error(err)
+	log.Flush()
+	os.Exit(1)
+}
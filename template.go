@@ -0,0 +1,201 @@
+package modern
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	js "github.com/rshmelev/go-json-light"
+)
+
+/*
+	string values of TrivialSetupConf and local.json are go templates:
+
+	LogsPath = {{ .AppDir }}/logs/{{ .Hostname }}
+	"dumps": "/tmp/{{ .AppName }}-{{ .PID }}-{{ date \"2006-01-02\" }}"
+	"db": "{{ env \"DATABASE_URL\" }}",  "region": "{{ envOr \"REGION\" \"eu\" }}"
+
+	unknown keys and missing env variables are errors, literal {{ is written as {{ "{{" }}.
+	dyn.json comes from the network and is not expanded (templates can read env),
+	unless ModernConf.ExpandDynTemplates (TrivialSetupConf.ExpandDynTemplates) is set
+*/
+
+type TemplateData struct {
+	AppDir      string
+	AppName     string
+	CompanyName string
+	Hostname    string
+	PID         int
+}
+
+var templateFuncs = template.FuncMap{
+	"env": func(key string) (string, error) {
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			return "", errors.New("env variable is not set: " + key)
+		}
+		return v, nil
+	},
+	"envOr": func(key, def string) string {
+		if v, ok := os.LookupEnv(key); ok {
+			return v
+		}
+		return def
+	},
+	"date": func(layout string) string {
+		return time.Now().Format(layout)
+	},
+	"utcdate": func(layout string) string {
+		return time.Now().UTC().Format(layout)
+	},
+}
+
+func NewTemplateData(appDir, appName, companyName string) *TemplateData {
+	hostname, _ := os.Hostname()
+	return &TemplateData{
+		AppDir:      appDir,
+		AppName:     appName,
+		CompanyName: companyName,
+		Hostname:    hostname,
+		PID:         os.Getpid(),
+	}
+}
+
+func (d *TemplateData) Expand(s string) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	t, err := template.New("conf").Option("missingkey=error").Funcs(templateFuncs).Parse(s)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, d); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// expands string (and []string) fields of config struct
+func (d *TemplateData) ExpandStruct(appname string, s interface{}) error {
+	var err error
+	walkConfFields(appname, s, func(f *confField) {
+		if err != nil {
+			return
+		}
+		err = d.expandValue(f.Path, f.Value)
+	})
+	return err
+}
+
+func (d *TemplateData) expandValue(path string, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		res, err := d.Expand(v.String())
+		if err != nil {
+			return errors.New("cannot expand template in " + path + ": " + err.Error())
+		}
+		v.SetString(res)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := d.expandValue(path, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// returns new object where all string values are expanded, o itself if nothing is expanded
+func (d *TemplateData) ExpandJSON(o js.IObject) (js.IObject, error) {
+	return mapJSONStrings(o, "{{", func(path, s string) (string, error) {
+		res, err := d.Expand(s)
+		if err != nil {
+			return "", errors.New("cannot expand template at " + F.OptString(path, "(root)") + ": " + err.Error())
+		}
+		return res, nil
+	})
+}
+
+// returns new object where every string value is replaced with fn(path, value),
+// o itself if json has no marker or fn hasn't changed anything
+func mapJSONStrings(o js.IObject, marker string, fn func(path, s string) (string, error)) (js.IObject, error) {
+	b := o.ToByteArray(0)
+	if !bytes.Contains(b, []byte(marker)) {
+		return o, nil
+	}
+	v, err := decodeJSONBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	changed := false
+	v, err = mapJSONValue("", v, func(path, s string) (string, error) {
+		res, err := fn(path, s)
+		if res != s {
+			changed = true
+		}
+		return res, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return o, nil
+	}
+	if b, err = json.Marshal(v); err != nil {
+		return nil, err
+	}
+	return js.NewObjectFromBytes(b)
+}
+
+// numbers are json.Number, so big integers are not rounded through float64
+func decodeJSONBytes(b []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after json value")
+	}
+	return v, nil
+}
+
+func mapJSONValue(path string, v interface{}, fn func(path, s string) (string, error)) (interface{}, error) {
+	switch x := v.(type) {
+	case string:
+		return fn(path, x)
+	case map[string]interface{}:
+		for k, vv := range x {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			res, err := mapJSONValue(p, vv, fn)
+			if err != nil {
+				return nil, err
+			}
+			x[k] = res
+		}
+	case []interface{}:
+		for i, vv := range x {
+			res, err := mapJSONValue(path+"["+strconv.Itoa(i)+"]", vv, fn)
+			if err != nil {
+				return nil, err
+			}
+			x[i] = res
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,166 @@
+package modern
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	js "github.com/rshmelev/go-json-light"
+)
+
+func testTemplateData() *TemplateData {
+	return &TemplateData{AppDir: "/opt/app", AppName: "myapp", CompanyName: "acme", Hostname: "host1", PID: 42}
+}
+
+func templateTestObject(t *testing.T, s string) js.IObject {
+	t.Helper()
+	o, err := js.NewObjectFromBytes([]byte(s))
+	if err != nil {
+		t.Fatalf("bad test json %s: %v", s, err)
+	}
+	return o
+}
+
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	av, err := decodeJSONBytes(a)
+	if err != nil {
+		t.Fatalf("bad json %s: %v", a, err)
+	}
+	bv, err := decodeJSONBytes(b)
+	if err != nil {
+		t.Fatalf("bad json %s: %v", b, err)
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+func TestTemplateExpand(t *testing.T) {
+	t.Setenv("MODERN_TEMPLATE_TEST", "value")
+
+	cases := []struct {
+		in, out string
+		err     string
+	}{
+		{"plain", "plain", ""},
+		{"", "", ""},
+		{"{{ .AppDir }}/logs/{{ .Hostname }}", "/opt/app/logs/host1", ""},
+		{"{{ .AppName }}-{{ .PID }}", "myapp-42", ""},
+		{`{{ env "MODERN_TEMPLATE_TEST" }}`, "value", ""},
+		{`{{ envOr "MODERN_TEMPLATE_MISSING" "eu" }}`, "eu", ""},
+		{`{{ envOr "MODERN_TEMPLATE_TEST" "eu" }}`, "value", ""},
+		{`{{ "{{" }} .AppDir }}`, "{{ .AppDir }}", ""},
+		{`{{ env "MODERN_TEMPLATE_MISSING" }}`, "", "env variable is not set: MODERN_TEMPLATE_MISSING"},
+		{"{{ .Unknown }}", "", "can't evaluate field Unknown"},
+		{"{{ .AppDir ", "", "unclosed action"},
+	}
+	d := testTemplateData()
+	for _, tc := range cases {
+		t.Run(tc.in, func(t *testing.T) {
+			res, err := d.Expand(tc.in)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error with %q, got %q, %v", tc.err, res, err)
+				}
+				return
+			}
+			if err != nil || res != tc.out {
+				t.Fatalf("expected %q, got %q, %v", tc.out, res, err)
+			}
+		})
+	}
+}
+
+func TestTemplateExpandJSON(t *testing.T) {
+	cases := []struct {
+		name, in, out string
+		err           string
+	}{
+		{"nested values", `{"a":{"b":"{{ .AppName }}"},"l":["x","{{ .PID }}"],"n":1}`, `{"a":{"b":"myapp"},"l":["x","42"],"n":1}`, ""},
+		{"numbers keep precision", `{"id":9007199254740993,"f":0.1,"s":"{{ .AppName }}"}`, `{"f":0.1,"id":9007199254740993,"s":"myapp"}`, ""},
+		{"escaped marker", `{"s":"{{ \"{{\" }}x"}`, `{"s":"{{x"}`, ""},
+		{"error has path", `{"a":{"l":["{{ .Nope }}"]}}`, "", "cannot expand template at a.l[0]"},
+	}
+	d := testTemplateData()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := d.ExpandJSON(templateTestObject(t, tc.in))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error with %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameJSON(t, res.ToByteArray(0), []byte(tc.out)) {
+				t.Fatalf("expected %s, got %s", tc.out, res.ToByteArray(0))
+			}
+		})
+	}
+}
+
+func TestTemplateExpandJSONUntouched(t *testing.T) {
+	d := testTemplateData()
+	for _, s := range []string{
+		`{"id":9007199254740993,"s":"plain"}`,
+		`{"{{ key":"plain","n":[1,2]}`,
+	} {
+		o := templateTestObject(t, s)
+		res, err := d.ExpandJSON(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != o {
+			t.Fatalf("object without templates should be returned as is: %s", s)
+		}
+	}
+}
+
+func TestTemplateExpandStruct(t *testing.T) {
+	conf := &struct {
+		LogsPath string
+		Files    []string
+		Port     int
+	}{
+		LogsPath: "{{ .AppDir }}/logs",
+		Files:    []string{"{{ .AppName }}.env", "other"},
+		Port:     80,
+	}
+	if err := testTemplateData().ExpandStruct("myapp", conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.LogsPath != "/opt/app/logs" || !reflect.DeepEqual(conf.Files, []string{"myapp.env", "other"}) {
+		t.Fatalf("unexpected result: %+v", conf)
+	}
+	bad := &struct{ LogsPath string }{"{{ .Nope }}"}
+	if err := testTemplateData().ExpandStruct("myapp", bad); err == nil || !strings.Contains(err.Error(), "LogsPath") {
+		t.Fatalf("expected error with field name, got %v", err)
+	}
+}
+
+func TestTransformDynTemplates(t *testing.T) {
+	t.Setenv("MODERN_TEMPLATE_TEST", "value")
+	src := `{"dir":"{{ .AppDir }}/x","env":"{{ env \"MODERN_TEMPLATE_TEST\" }}"}`
+
+	cases := []struct {
+		name   string
+		expand bool
+		res    string
+	}{
+		{"not expanded by default", false, src},
+		{"opt-in", true, `{"dir":"/opt/app/x","env":"value"}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &ModernConf{Templates: testTemplateData(), ExpandDynTemplates: tc.expand}
+			res, err := c.transformDyn(templateTestObject(t, src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameJSON(t, res.ToByteArray(0), []byte(tc.res)) {
+				t.Fatalf("expected %s, got %s", tc.res, res.ToByteArray(0))
+			}
+		})
+	}
+}
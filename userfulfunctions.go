@@ -132,9 +132,12 @@ func (f *UsefulFunctions) GetContents(url string, timeout time.Duration) *HttpSt
 }
 
 type HttpByteResponse struct {
-	Body []byte
-	Err  error
-	Code int
+	Body         []byte
+	Err          error
+	Code         int
+	ContentType  string
+	ETag         string
+	LastModified string
 }
 
 func (r *HttpByteResponse) ToStringOrError() string {
@@ -157,6 +160,12 @@ type HttpStringResponse struct {
 }
 
 func (f *UsefulFunctions) GetByteContents(url string, timeout time.Duration) *HttpByteResponse {
+	return f.GetByteContentsIfModified(url, timeout, "", "")
+}
+
+// conditional GET: code 304 with empty body means content is the same as for given etag/lastModified.
+// files are always read
+func (f *UsefulFunctions) GetByteContentsIfModified(url string, timeout time.Duration, etag, lastModified string) *HttpByteResponse {
 	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
 		tr := &http.Transport{
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
@@ -165,7 +174,17 @@ func (f *UsefulFunctions) GetByteContents(url string, timeout time.Duration) *Ht
 			Timeout:   timeout,
 			Transport: tr,
 		}
-		r, err := client.Get(url)
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return &HttpByteResponse{Err: err}
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+		r, err := client.Do(req)
 		defer func() {
 			if r != nil && r.Body != nil {
 				r.Body.Close()
@@ -175,25 +194,32 @@ func (f *UsefulFunctions) GetByteContents(url string, timeout time.Duration) *Ht
 		//fmt.Printf("%#v\n", r)
 
 		if err != nil {
-			return &HttpByteResponse{nil, err, 0}
+			return &HttpByteResponse{Err: err}
 		}
 
 		x, err := ioutil.ReadAll(r.Body)
 
-		return &HttpByteResponse{x, nil, r.StatusCode}
+		return &HttpByteResponse{
+			Body:         x,
+			Err:          err,
+			Code:         r.StatusCode,
+			ContentType:  r.Header.Get("Content-Type"),
+			ETag:         r.Header.Get("ETag"),
+			LastModified: r.Header.Get("Last-Modified"),
+		}
 	} else {
 		bytes, err := ioutil.ReadFile(url)
 		if err != nil {
 			switch {
 			case os.IsNotExist(err):
-				return &HttpByteResponse{nil, err, 404}
+				return &HttpByteResponse{Err: err, Code: 404}
 			case os.IsPermission(err):
-				return &HttpByteResponse{nil, err, 403}
+				return &HttpByteResponse{Err: err, Code: 403}
 			default:
-				return &HttpByteResponse{nil, err, 500}
+				return &HttpByteResponse{Err: err, Code: 500}
 			}
 		}
-		return &HttpByteResponse{bytes, nil, 200}
+		return &HttpByteResponse{Body: bytes, Code: 200}
 	}
 }
 
@@ -0,0 +1,143 @@
+package modern
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/*
+	minimal validation of config structs with `validate` tag:
+
+	type Dyn struct {
+		Mode    string        `json:"mode" validate:"required,oneof=fast safe"`
+		Workers int           `json:"workers" init:"4" validate:"min=1,max=64"`
+		Hosts   []string      `json:"hosts" validate:"min=1"`
+	}
+
+	min/max compare numbers by value and strings, slices and maps by length.
+	nested structs are validated too, and if struct has Validate() error method it's called
+*/
+
+type Validator interface {
+	Validate() error
+}
+
+// returns the first problem found in struct that s points to
+func ValidateStruct(s interface{}) error {
+	v := reflect.ValueOf(s)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	return validateStruct("", v)
+}
+
+func validateStruct(path string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		fv := v.Field(i)
+		p := path + jsonFieldName(sf)
+
+		if tag := sf.Tag.Get("validate"); tag != "" {
+			for _, rule := range strings.Split(tag, ",") {
+				if err := validateRule(fv, strings.TrimSpace(rule)); err != nil {
+					return errors.New(p + ": " + err.Error())
+				}
+			}
+		}
+
+		sv := fv
+		if sv.Kind() == reflect.Ptr && !sv.IsNil() {
+			sv = sv.Elem()
+		}
+		if sv.Kind() == reflect.Struct {
+			if err := validateStruct(p+".", sv); err != nil {
+				return err
+			}
+		}
+	}
+
+	if v.CanAddr() {
+		if vv, ok := v.Addr().Interface().(Validator); ok {
+			if err := vv.Validate(); err != nil {
+				return errors.New(F.OptString(strings.TrimSuffix(path, "."), "(root)") + ": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func jsonFieldName(sf reflect.StructField) string {
+	if name := strings.Split(sf.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+		return name
+	}
+	return sf.Name
+}
+
+func validateRule(v reflect.Value, rule string) error {
+	name, arg := rule, ""
+	if i := strings.Index(rule, "="); i >= 0 {
+		name, arg = rule[:i], rule[i+1:]
+	}
+	switch name {
+	case "":
+		return nil
+	case "required":
+		if v.IsZero() {
+			return errors.New("is required")
+		}
+	case "min", "max":
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return errors.New("bad validate rule: " + rule)
+		}
+		n, ok := measure(v)
+		if !ok {
+			return errors.New("rule " + name + " is not supported for " + v.Type().String())
+		}
+		if name == "min" && n < limit {
+			return fmt.Errorf("should be at least %v", arg)
+		}
+		if name == "max" && n > limit {
+			return fmt.Errorf("should be at most %v", arg)
+		}
+	case "oneof":
+		s := fmt.Sprint(v.Interface())
+		for _, allowed := range strings.Fields(arg) {
+			if s == allowed {
+				return nil
+			}
+		}
+		return errors.New("should be one of: " + arg)
+	default:
+		return errors.New("unknown validate rule: " + rule)
+	}
+	return nil
+}
+
+// number value or length
+func measure(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return float64(v.Len()), true
+	}
+	return 0, false
+}
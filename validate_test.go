@@ -0,0 +1,105 @@
+package modern
+
+import (
+	"errors"
+	"testing"
+)
+
+type validateInner struct {
+	Port int `json:"port" validate:"min=1,max=65535"`
+}
+
+type validateConf struct {
+	Mode    string            `json:"mode" validate:"required,oneof=fast safe"`
+	Workers int               `json:"workers" validate:"min=1,max=64"`
+	Hosts   []string          `json:"hosts" validate:"min=1"`
+	Ratio   float64           `json:"ratio" validate:"max=1"`
+	Tags    map[string]string `validate:"max=2"`
+	Inner   validateInner     `json:"inner"`
+	Ptr     *validateInner    `json:"ptr"`
+	skipped int               `validate:"required"`
+}
+
+type validateSelf struct {
+	A, B int
+}
+
+func (s *validateSelf) Validate() error {
+	if s.A > s.B {
+		return errors.New("A is greater than B")
+	}
+	return nil
+}
+
+type validateBadRule struct {
+	N int `validate:"between=1"`
+}
+
+type validateBadType struct {
+	B bool `validate:"min=1"`
+}
+
+func validConf() validateConf {
+	return validateConf{Mode: "fast", Workers: 4, Hosts: []string{"a"}, Inner: validateInner{Port: 80}}
+}
+
+func TestValidateStruct(t *testing.T) {
+	cases := []struct {
+		name string
+		conf func(c *validateConf)
+		err  string
+	}{
+		{"valid", func(c *validateConf) {}, ""},
+		{"required", func(c *validateConf) { c.Mode = "" }, "mode: is required"},
+		{"oneof", func(c *validateConf) { c.Mode = "slow" }, "mode: should be one of: fast safe"},
+		{"min number", func(c *validateConf) { c.Workers = 0 }, "workers: should be at least 1"},
+		{"max number", func(c *validateConf) { c.Workers = 65 }, "workers: should be at most 64"},
+		{"max float", func(c *validateConf) { c.Ratio = 1.5 }, "ratio: should be at most 1"},
+		{"min length", func(c *validateConf) { c.Hosts = nil }, "hosts: should be at least 1"},
+		{"max map length", func(c *validateConf) { c.Tags = map[string]string{"a": "", "b": "", "c": ""} }, "Tags: should be at most 2"},
+		{"nested", func(c *validateConf) { c.Inner.Port = 0 }, "inner.port: should be at least 1"},
+		{"nested pointer", func(c *validateConf) { c.Ptr = &validateInner{Port: 70000} }, "ptr.port: should be at most 65535"},
+		{"nil pointer", func(c *validateConf) { c.Ptr = nil }, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := validConf()
+			tc.conf(&c)
+			checkValidateError(t, ValidateStruct(&c), tc.err)
+		})
+	}
+}
+
+func TestValidateStructSpecial(t *testing.T) {
+	var nilConf *validateConf
+	cases := []struct {
+		name string
+		v    interface{}
+		err  string
+	}{
+		{"nil pointer", nilConf, ""},
+		{"not a struct", 5, ""},
+		{"Validate method ok", &validateSelf{A: 1, B: 2}, ""},
+		{"Validate method fails", &validateSelf{A: 3, B: 2}, "(root): A is greater than B"},
+		{"unknown rule", &validateBadRule{}, "N: unknown validate rule: between=1"},
+		{"unsupported type", &validateBadType{}, "B: rule min is not supported for bool"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			checkValidateError(t, ValidateStruct(tc.v), tc.err)
+		})
+	}
+}
+
+func checkValidateError(t *testing.T, err error, expected string) {
+	t.Helper()
+	if expected == "" {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return
+	}
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected error %q, got %v", expected, err)
+	}
+}